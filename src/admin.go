@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registration status of a service label on a container, as reported by the
+// admin API and the dockconsul_container_status gauge.
+const (
+	statusPending         = "pending"
+	statusRegistered      = "registered"
+	statusParseError      = "parse_error"
+	statusValidationError = "validation_error"
+	statusRegisterFailed  = "register_failed"
+	statusSidecarFailed   = "sidecar_failed"
+)
+
+// ManagedService is what the agent knows about one service after the last
+// cycle, as returned by the admin API.
+type ManagedService struct {
+	ID            string         `json:"id"`
+	Name          string         `json:"name"`
+	ContainerID   string         `json:"container_id"`
+	ContainerName string         `json:"container_name"`
+	Status        string         `json:"status"`
+	Target        string         `json:"target"`
+	Namespace     string         `json:"namespace,omitempty"`
+	Partition     string         `json:"partition,omitempty"`
+	Payload       map[string]any `json:"payload,omitempty"`
+	RegisteredAt  *time.Time     `json:"registered_at,omitempty"`
+	LastError     string         `json:"last_error,omitempty"`
+	Sidecar       *SidecarStatus `json:"sidecar,omitempty"`
+}
+
+// SidecarStatus is the state of a service's sidecar container.
+type SidecarStatus struct {
+	Provider     string `json:"provider"`
+	ContainerID  string `json:"container_id,omitempty"`
+	State        string `json:"state"`
+	RestartCount int    `json:"restart_count"`
+	ExitCode     int    `json:"exit_code"`
+	Failure      string `json:"failure,omitempty"`
+}
+
+// ContainerStatus is the outcome of one consul.service.<name> label of a
+// container in the last cycle. Labels that could not be parsed or validated
+// have no service ID.
+type ContainerStatus struct {
+	ContainerID   string `json:"container_id"`
+	ContainerName string `json:"container_name"`
+	Service       string `json:"service"`
+	ServiceID     string `json:"service_id,omitempty"`
+	Status        string `json:"status"`
+	Message       string `json:"message,omitempty"`
+}
+
+func (m *ManagedService) setError(err error) {
+	if m != nil && err != nil {
+		m.LastError = err.Error()
+	}
+}
+
+// redacted returns a copy of m whose payload is safe to serve: secrets are
+// replaced as in the logs.
+func (m *ManagedService) redacted() *ManagedService {
+	out := *m
+	out.Payload, _ = redactPayload(m.Payload).(map[string]any)
+	return &out
+}
+
+// fail records err and the status it leaves the service in.
+func (m *ManagedService) fail(status string, err error) {
+	m.Status = status
+	m.setError(err)
+}
+
+// containerStatuses merges the services of view with the labels rejected
+// before a service could be built, sorted by container and service.
+func containerStatuses(view map[string]*ManagedService, rejected []ContainerStatus) []ContainerStatus {
+	out := append([]ContainerStatus(nil), rejected...)
+	for _, m := range view {
+		out = append(out, ContainerStatus{
+			ContainerID:   m.ContainerID,
+			ContainerName: m.ContainerName,
+			Service:       m.Name,
+			ServiceID:     m.ID,
+			Status:        m.Status,
+			Message:       m.LastError,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].ContainerName != out[j].ContainerName {
+			return out[i].ContainerName < out[j].ContainerName
+		}
+		return out[i].Service < out[j].Service
+	})
+	return out
+}
+
+func (s *SidecarStatus) fill(si *DockerInspect, failure string) {
+	s.ContainerID = si.ID
+	s.State = si.State.Status
+	s.RestartCount = si.RestartCount
+	s.ExitCode = si.State.ExitCode
+	s.Failure = failure
+}
+
+// publish replaces the view returned by the admin API and the container
+// status gauge.
+func (a *Agent) publish(view map[string]*ManagedService, rejected []ContainerStatus) {
+	statuses := containerStatuses(view, rejected)
+
+	a.metrics.ContainerStatus.Reset()
+	for _, s := range statuses {
+		a.metrics.ContainerStatus.WithLabelValues(s.ContainerName, s.Service, s.Status).Set(1)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.managed = view
+	a.containers = statuses
+}
+
+// ManagedServices returns the services handled in the last cycle, sorted by
+// ID.
+func (a *Agent) ManagedServices() []*ManagedService {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make([]*ManagedService, 0, len(a.managed))
+	for _, m := range a.managed {
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// ContainerStatuses returns the status of every service label seen in the
+// last cycle. A non-empty container restricts the result to the container
+// with that ID or name.
+func (a *Agent) ContainerStatuses(container string) []ContainerStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := []ContainerStatus{}
+	for _, s := range a.containers {
+		if container == "" || s.ContainerID == container || s.ContainerName == container {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (a *Agent) ManagedService(id string) (*ManagedService, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	m, ok := a.managed[id]
+	return m, ok
+}
+
+// ForceReregister asks the next cycle to register id even if its payload is
+// unchanged. It returns false if the service is not managed.
+func (a *Agent) ForceReregister(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.managed[id]; !ok {
+		return false
+	}
+	if a.forced == nil {
+		a.forced = map[string]bool{}
+	}
+	a.forced[id] = true
+	return true
+}
+
+func (a *Agent) takeForced() map[string]bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	forced := a.forced
+	a.forced = nil
+	return forced
+}
+
+// AdminAPI serves the admin endpoints under /admin/:
+//
+//	GET  /admin/services                 managed services
+//	GET  /admin/services/<id>            one managed service
+//	GET  /admin/containers               status of every service label
+//	GET  /admin/containers/<id|name>     status of the labels of one container
+//	POST /admin/reconcile                run a cycle now
+//	POST /admin/services/<id>/reregister re-register one service now
+//
+// The API answers 404 while disabled. When a token is set, requests must
+// send it as a bearer token; without one, Validate only accepts a loopback
+// METRICS_ADDR. Payloads are redacted like the debug logs.
+type AdminAPI struct {
+	agent   *Agent
+	trigger chan<- struct{}
+
+	mu      sync.Mutex
+	enabled bool
+	token   string
+}
+
+// NewAdminAPI returns the admin API of agent. Reconciliations are requested
+// by a non-blocking send on trigger.
+func NewAdminAPI(agent *Agent, trigger chan<- struct{}) *AdminAPI {
+	return &AdminAPI{agent: agent, trigger: trigger}
+}
+
+// Configure applies the admin settings of cfg, at startup and on reload.
+func (api *AdminAPI) Configure(cfg *Config) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.enabled = cfg.AdminEnabled
+	api.token = cfg.AdminToken
+}
+
+func (api *AdminAPI) settings() (enabled bool, token string) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.enabled, api.token
+}
+
+func (api *AdminAPI) authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func (api *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	enabled, token := api.settings()
+	if !enabled {
+		http.NotFound(w, r)
+		return
+	}
+	if !api.authorized(r, token) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin"), "/")
+	switch {
+	case path == "services":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		services := api.agent.ManagedServices()
+		out := make([]*ManagedService, len(services))
+		for i, m := range services {
+			out[i] = m.redacted()
+		}
+		writeJSON(w, http.StatusOK, out)
+
+	case path == "containers":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, api.agent.ContainerStatuses(""))
+
+	case strings.HasPrefix(path, "containers/"):
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		id := strings.TrimPrefix(path, "containers/")
+		statuses := api.agent.ContainerStatuses(id)
+		if len(statuses) == 0 {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown container " + id})
+			return
+		}
+		writeJSON(w, http.StatusOK, statuses)
+
+	case path == "reconcile":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		api.requestReconcile()
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "scheduled"})
+
+	case strings.HasPrefix(path, "services/") && strings.HasSuffix(path, "/reregister"):
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "services/"), "/reregister")
+		if !api.agent.ForceReregister(id) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown service " + id})
+			return
+		}
+		api.requestReconcile()
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "scheduled", "id": id})
+
+	case strings.HasPrefix(path, "services/"):
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		id := strings.TrimPrefix(path, "services/")
+		m, ok := api.agent.ManagedService(id)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown service " + id})
+			return
+		}
+		writeJSON(w, http.StatusOK, m.redacted())
+
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+	}
+}
+
+func (api *AdminAPI) requestReconcile() {
+	select {
+	case api.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAPIRedactsPayloads(t *testing.T) {
+	payload := map[string]any{
+		"name": "web",
+		"meta": map[string]any{"api_token": "s3cr3t", "version": "1"},
+		"checks": []any{map[string]any{
+			"HTTP":   "http://web/health",
+			"Header": map[string]any{"Authorization": []any{"Bearer s3cr3t"}},
+		}},
+	}
+	agent := &Agent{managed: map[string]*ManagedService{
+		"consul:abc:web": {ID: "consul:abc:web", Name: "web", Payload: payload},
+	}}
+	api := NewAdminAPI(agent, make(chan struct{}, 1))
+	api.Configure(&Config{AdminEnabled: true, AdminToken: "admin"})
+
+	for _, path := range []string{"/admin/services", "/admin/services/consul:abc:web"} {
+		t.Run(path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("Authorization", "Bearer admin")
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+			}
+
+			var m ManagedService
+			body := rec.Body.Bytes()
+			if path == "/admin/services" {
+				var list []ManagedService
+				if err := json.Unmarshal(body, &list); err != nil || len(list) != 1 {
+					t.Fatalf("decode %s: %v", body, err)
+				}
+				m = list[0]
+			} else if err := json.Unmarshal(body, &m); err != nil {
+				t.Fatal(err)
+			}
+
+			meta := m.Payload["meta"].(map[string]any)
+			if meta["api_token"] != redacted || meta["version"] != "1" {
+				t.Errorf("meta = %v, want api_token redacted", meta)
+			}
+			check := m.Payload["checks"].([]any)[0].(map[string]any)
+			if h := check["Header"].(map[string]any)["Authorization"]; h != redacted {
+				t.Errorf("check header = %v, want it redacted", h)
+			}
+		})
+	}
+
+	if payload["meta"].(map[string]any)["api_token"] != "s3cr3t" {
+		t.Error("redaction modified the agent's payload")
+	}
+}
+
+func TestAdminAPIToken(t *testing.T) {
+	api := NewAdminAPI(&Agent{}, make(chan struct{}, 1))
+
+	tests := []struct {
+		name string
+		cfg  *Config
+		auth string
+		want int
+	}{
+		{name: "disabled", cfg: &Config{}, want: http.StatusNotFound},
+		{name: "missing token", cfg: &Config{AdminEnabled: true, AdminToken: "admin"}, want: http.StatusUnauthorized},
+		{name: "wrong token", cfg: &Config{AdminEnabled: true, AdminToken: "admin"}, auth: "Bearer nope", want: http.StatusUnauthorized},
+		{name: "token", cfg: &Config{AdminEnabled: true, AdminToken: "admin"}, auth: "Bearer admin", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api.Configure(tt.cfg)
+			req := httptest.NewRequest(http.MethodGet, "/admin/services", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -5,40 +5,128 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"hash/fnv"
+	"log/slog"
 	"net"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const defaultReRegisterInterval = 5 * time.Minute
 
 type Agent struct {
-	docker    *DockerClient
-	consul    *ConsulClient
-	metrics   *Metrics
-	state     *State
-	statePath string
-	cfg       *Config
-
-	servicePayloadHash map[string]string
-	lastRegisterAt      map[string]time.Time
+	docker *DockerClient
+	// targets are the Consul clients by target name.
+	targets map[string]*ConsulClient
+	metrics *Metrics
+	health  *Health
+	// states and stores hold the reconciliation state of each target.
+	states map[string]*State
+	stores map[string]StateStore
+	cfg    *Config
+
+	// sidecarFailing holds, by service ID, the failure last reported for
+	// each sidecar seen in the previous cycle.
+	sidecarFailing map[string]sidecarNote
+	// imageDigests caches the repository digest of images by image ID.
+	imageDigests map[string]string
+
+	// mu guards the fields shared with the admin API.
+	mu sync.Mutex
+	// managed is the view of the services handled in the last cycle.
+	managed map[string]*ManagedService
+	// containers is the status of every service label in the last cycle.
+	containers []ContainerStatus
+	// forced holds service IDs to re-register in the next cycle.
+	forced map[string]bool
 }
 
-func NewAgent(d *DockerClient, c *ConsulClient, m *Metrics, s *State, statePath string, cfg *Config) *Agent {
+func NewAgent(d *DockerClient, targets map[string]*ConsulClient, m *Metrics, h *Health, states map[string]*State, stores map[string]StateStore, cfg *Config) *Agent {
 	return &Agent{
-		docker:              d,
-		consul:              c,
-		metrics:             m,
-		state:               s,
-		statePath:           statePath,
-		cfg:                 cfg,
-		servicePayloadHash:  map[string]string{},
-		lastRegisterAt:      map[string]time.Time{},
+		docker:  d,
+		targets: targets,
+		metrics: m,
+		health:  h,
+		states:  states,
+		stores:  stores,
+		cfg:     cfg,
+	}
+}
+
+// Reload swaps the clients, state stores and configuration used by the next
+// cycles; stores is nil when the targets did not change. The states are
+// kept, so existing registrations are not dropped, and so are the stores of
+// removed targets: their services stay recorded until they can be
+// deregistered.
+func (a *Agent) Reload(d *DockerClient, targets map[string]*ConsulClient, stores map[string]StateStore, cfg *Config) {
+	a.docker = d
+	a.targets = targets
+	for name, store := range stores {
+		a.stores[name] = store
+	}
+	a.cfg = cfg
+}
+
+// stateOf returns the state of a target, created empty the first time.
+func (a *Agent) stateOf(target string) *State {
+	st, ok := a.states[target]
+	if !ok {
+		st = newState()
+		a.states[target] = st
+	}
+	return st
+}
+
+// serviceState returns the state of the target serviceID is registered
+// with, or nil if it is not.
+func (a *Agent) serviceState(serviceID string) *State {
+	for _, name := range sortedKeys(a.states) {
+		if st := a.states[name]; st.Services[serviceID] {
+			return st
+		}
 	}
+	return nil
+}
+
+// serviceCount is the number of services registered with all the targets.
+func (a *Agent) serviceCount() int {
+	n := 0
+	for _, st := range a.states {
+		n += len(st.Services)
+	}
+	return n
+}
+
+// client returns the client of the scope's target.
+func (a *Agent) client(scope ConsulScope) (*ConsulClient, error) {
+	c, ok := a.targets[scope.targetName()]
+	if !ok {
+		return nil, fmt.Errorf("unknown consul target %q", scope.targetName())
+	}
+	return c, nil
+}
+
+// sidecarProvider returns the provider for a service: the one named in its
+// overrides, else the configured default.
+func (a *Agent) sidecarProvider(ov *SidecarOverrides) (SidecarProvider, error) {
+	kind := a.cfg.SidecarProvider
+	if ov != nil && ov.Provider != "" {
+		kind = ov.Provider
+	}
+	p, ok := a.cfg.sidecarProviders[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown sidecar provider %q", kind)
+	}
+	return p, nil
 }
 
 func (a *Agent) RunOnce() error {
@@ -47,64 +135,204 @@ func (a *Agent) RunOnce() error {
 	return a.Run(ctx)
 }
 
-func (a *Agent) Run(ctx context.Context) error {
-	containers, err := a.docker.ListContainers(ctx)
+func (a *Agent) Run(ctx context.Context) (err error) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "reconcile")
+	defer func() {
+		endSpan(span, err)
+		outcome := "success"
+		if err != nil {
+			outcome = "error"
+		}
+		a.metrics.ReconcileDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+		a.health.RecordReconcile(err)
+	}()
+
+	containers, err := a.docker.ListContainers(ctx, a.cfg.containerFilters())
+	if err == nil {
+		// Sidecars are listed apart: the filters select the containers to
+		// register, not the sidecars launched for them.
+		var sidecars []DockerContainer
+		sidecars, err = a.docker.ListContainers(ctx, map[string][]string{"label": {"consul-registrator=sidecar"}})
+		seen := map[string]bool{}
+		for _, c := range containers {
+			seen[c.ID] = true
+		}
+		for _, c := range sidecars {
+			if !seen[c.ID] {
+				containers = append(containers, c)
+			}
+		}
+	}
+	a.health.RecordDocker(err)
 	if err != nil {
-		a.metrics.Errors.Inc()
+		a.metrics.Errors.WithLabelValues(errClassDocker).Inc()
 		return err
 	}
 	a.metrics.Containers.Set(float64(len(containers)))
-	log.Printf("reconcile start containers=%d", len(containers))
+	span.SetAttributes(attribute.Int("containers", len(containers)))
+	slog.InfoContext(ctx, "reconcile start", "action", "reconcile", "containers", len(containers))
 
 	sidecarsByServiceID := map[string]DockerContainer{}
+	sidecarInspects := map[string]*DockerInspect{}
 	for _, c := range containers {
-		if c.Labels["consul-registrator"] != "sidecar" {
+		if c.Labels["consul-registrator"] != "sidecar" || !a.cfg.ownsSidecar(c.Labels) {
 			continue
 		}
 		if sid := c.Labels["service-id"]; sid != "" {
 			sidecarsByServiceID[sid] = c
+			if si, err := a.inspect(ctx, c.ID); err == nil {
+				sidecarInspects[sid] = si
+			}
 		}
 	}
 
+	// One listing per cycle and scope is enough to detect hand edits or
+	// deregistrations of managed services. If it fails, fall back to
+	// per-service verification.
+	live, err := a.liveServices(ctx)
+	a.health.RecordConsul(err)
+	if err != nil {
+		a.metrics.Errors.WithLabelValues(errClassConsul).Inc()
+		slog.WarnContext(ctx, "failed to list consul agent services, drift detection skipped", "error", err)
+		live = nil
+	}
+
 	found := map[string]bool{}
+	// unwanted holds the found services whose sidecar label is gone or off.
+	unwanted := map[string]bool{}
+	// deregistered holds the services removed from Consul this cycle, which
+	// the catalog may still list.
+	deregistered := map[string]bool{}
+	view := map[string]*ManagedService{}
+	// rejected holds the labels that did not yield a service.
+	var rejected []ContainerStatus
+	forced := a.takeForced()
+	var outdated []sidecarRecreate
+	// configEntries are the config entries declared by the service labels.
+	configEntries := map[string]*desiredConfigEntry{}
+	// Per cycle counts for the gauges, by service name or outcome.
+	registered := map[string]int{}
+	ttlChecks := map[string]int{}
+	launched := map[string]int{}
 
 	for _, c := range containers {
-		insp, err := a.docker.Inspect(ctx, c.ID)
-		if err != nil {
-			a.metrics.Errors.Inc()
+		switch c.Labels["consul-registrator"] {
+		case "sidecar", "sidecar-init":
 			continue
 		}
 
-		if c.Labels["consul-registrator"] == "sidecar" {
+		ctx, span := tracer.Start(ctx, "container", trace.WithAttributes(attribute.String("container.id", c.ID)))
+		insp, err := a.inspect(ctx, c.ID)
+		if err != nil {
+			endSpan(span, err)
 			continue
 		}
+		containerName := strings.TrimPrefix(insp.Name, "/")
+		span.SetAttributes(attribute.String("container.name", containerName))
 
+		servicePrefix := a.cfg.serviceLabelPrefix()
 		var keys []string
 		for k := range insp.Config.Labels {
-			if strings.HasPrefix(k, "consul.service.") {
+			if strings.HasPrefix(k, servicePrefix) {
 				keys = append(keys, k)
-			} else if k == "consul.service" {
-				log.Printf("container=%s label 'consul.service' is not supported, must use 'consul.service.<name>'", insp.ID)
+			} else if k == strings.TrimSuffix(servicePrefix, ".") {
+				slog.WarnContext(ctx, "label '"+k+"' is not supported, must use '"+servicePrefix+"<name>'", "container", insp.ID)
 			}
 		}
 		sort.Strings(keys)
 
 		for _, k := range keys {
-			labelName := strings.TrimPrefix(k, "consul.service.")
-			svc, err := ParseServiceHCL(insp.Config.Labels[k])
+			labelName := strings.TrimPrefix(k, servicePrefix)
+			_, parseSpan := tracer.Start(ctx, "parse_label", trace.WithAttributes(attribute.String("label", k)))
+			parsed, err := parseServiceLabel(insp.Config.Labels[k], labelName)
+			endSpan(parseSpan, err)
 			if err != nil {
-				log.Printf("container=%s failed to parse label=%s error=%v", insp.ID, k, err)
+				a.metrics.Errors.WithLabelValues(errClassLabel).Inc()
+				a.metrics.Skips.WithLabelValues(labelName, "invalid_label").Inc()
+				slog.ErrorContext(ctx, "failed to parse label", "container", insp.ID, "label", k, "error", err)
+				rejected = append(rejected, ContainerStatus{
+					ContainerID:   insp.ID,
+					ContainerName: containerName,
+					Service:       labelName,
+					Status:        statusParseError,
+					Message:       err.Error(),
+				})
 				continue
 			}
 
+			svc := parsed.Service
 			svcName, ok := svc["name"].(string)
 			if !ok || svcName == "" || svcName != labelName {
-				log.Printf("container=%s invalid/mismatched service.name=%q for label=%q", insp.ID, svcName, labelName)
+				a.metrics.Errors.WithLabelValues(errClassLabel).Inc()
+				a.metrics.Skips.WithLabelValues(labelName, "invalid_label").Inc()
+				slog.ErrorContext(ctx, "invalid or mismatched service name", "container", insp.ID, "service", svcName, "label", k)
+				rejected = append(rejected, ContainerStatus{
+					ContainerID:   insp.ID,
+					ContainerName: containerName,
+					Service:       labelName,
+					Status:        statusValidationError,
+					Message:       fmt.Sprintf("service name %q does not match label %s", svcName, k),
+				})
 				continue
 			}
 
-			serviceID := makeServiceID(insp.ID, svcName)
+			serviceID := makeServiceID(a.cfg.LabelPrefix, insp.ID, svcName)
 			svc["id"] = serviceID
+			targetKey := a.cfg.targetLabel(labelName)
+			target, targetOK := a.cfg.target(insp.Config.Labels[targetKey])
+			scope := serviceScope(svc, target.scope())
+			entry := &ManagedService{
+				ID:            serviceID,
+				Name:          svcName,
+				ContainerID:   insp.ID,
+				ContainerName: containerName,
+				Status:        statusPending,
+				Target:        scope.targetName(),
+				Namespace:     scope.Namespace,
+				Partition:     scope.Partition,
+			}
+			view[serviceID] = entry
+
+			consul, err := a.client(scope)
+			if !targetOK || err != nil {
+				err = fmt.Errorf("unknown consul target %q", insp.Config.Labels[targetKey])
+				a.keepRegistration(ctx, found, entry, statusValidationError, targetKey, err)
+				continue
+			}
+
+			if err := desireConfigEntries(ctx, configEntries, parsed.ConfigEntries, svcName, scope, entry); err != nil {
+				a.keepRegistration(ctx, found, entry, statusValidationError, k, err)
+				continue
+			}
+
+			sidecarKey := a.cfg.sidecarLabel(labelName)
+			sidecarLabel, sidecarRequested := insp.Config.Labels[sidecarKey]
+			sidecarRequested = sidecarRequested && !sidecarDisabled(sidecarLabel)
+			var overrides *SidecarOverrides
+			if sidecarRequested {
+				overrides, err = ParseSidecarOverrides(sidecarLabel)
+				if err != nil {
+					a.keepRegistration(ctx, found, entry, statusParseError, sidecarKey, err)
+					continue
+				}
+			}
+			provider, err := a.sidecarProvider(overrides)
+			if err != nil {
+				a.keepRegistration(ctx, found, entry, statusValidationError, sidecarKey, err)
+				continue
+			}
+
+			upstreamsKey := a.cfg.upstreamsLabel(labelName)
+			upstreams, err := parseUpstreamsLabel(insp.Config.Labels[upstreamsKey])
+			if err != nil {
+				a.keepRegistration(ctx, found, entry, statusParseError, upstreamsKey, err)
+				continue
+			}
+			if err := addUpstreams(svc, append(parsed.Upstreams, upstreams...), sidecarRequested, overrides); err != nil {
+				a.keepRegistration(ctx, found, entry, statusValidationError, upstreamsKey, err)
+				continue
+			}
 
 			if _, hasAddress := svc["address"]; !hasAddress {
 				if _, hasAddress := svc["Address"]; !hasAddress {
@@ -115,92 +343,507 @@ func (a *Agent) Run(ctx context.Context) error {
 				}
 			}
 
-			sidecarKey := "consul.sidecar." + labelName
-			_, sidecarRequested := insp.Config.Labels[sidecarKey]
-			applySidecarAutoAndProm(svc, svcName, serviceID, a.cfg, sidecarRequested)
-			applyAutoTCPCheckOnServiceOrEnvoy(svc, svcName)
-			injectTagsAndMeta(svc, insp, sidecarRequested, a.cfg, serviceID)
+			readyPort := provider.ReadyPort(overrides)
+			applySidecarAutoAndProm(svc, svcName, serviceID, a.cfg, sidecarRequested, readyPort, overrides)
+			applyBootstrapOverrides(svc, overrides)
+			applyAutoTCPCheckOnServiceOrEnvoy(svc, svcName, overrides)
+			if sidecarRequested && a.cfg.SidecarEnabled {
+				applyEnvoyReadyGate(svc, svcName, readyPort)
+			}
+			defaultTags(svc, insp)
+			injectTagsAndMeta(svc, insp, sidecarRequested, a.cfg, serviceID, provider.Kind())
+			mergeMeta(svc, containerMeta(insp, a.imageDigest(ctx, insp)), false)
 
 			found[serviceID] = true
+			if !sidecarRequested {
+				unwanted[serviceID] = true
+			}
+			entry.Payload = svc
 			payloadHash := hashServicePayload(svc)
 
-			shouldRegister := false
-			if !a.state.Services[serviceID] {
-				shouldRegister = true
-			} else if prev, ok := a.servicePayloadHash[serviceID]; !ok || prev != payloadHash {
-				shouldRegister = true
-			} else {
-				last := a.lastRegisterAt[serviceID]
-				if time.Since(last) >= defaultReRegisterInterval {
-					shouldRegister = true
+			st := a.stateOf(scope.targetName())
+			prevState := a.serviceState(serviceID)
+
+			// reason is why the service must be (re-)registered, "" if not.
+			reason := ""
+			if forced[serviceID] {
+				reason = "forced"
+			} else if prevState == nil {
+				reason = "new"
+			} else if prevState != st || st.Scopes[serviceID] != scope {
+				reason = "changed"
+			} else if prev, ok := st.ServiceHashes[serviceID]; !ok || prev != payloadHash {
+				reason = "changed"
+			} else if live != nil {
+				var current *AgentServiceInfo
+				if info, ok := live[serviceID]; ok {
+					current = &info
+				}
+				if current != nil && !a.cfg.LegacyTags && hasLegacyTags(current.Tags) {
+					// Registered before the bookkeeping moved to meta.
+					slog.InfoContext(ctx, "removing legacy bookkeeping tags", "container", insp.ID, "service", svcName, "service_id", serviceID)
+					reason = "cleanup"
+				} else if diffs := diffService(svc, current); len(diffs) > 0 {
+					logDrift(insp.ID, svcName, serviceID, diffs)
+					a.metrics.Drift.WithLabelValues(svcName).Inc()
+					reason = "drift"
+				} else {
+					st.VerifiedAt[serviceID] = time.Now()
+				}
+			} else if a.verifyDue(st, serviceID) {
+				current, _, err := consul.AgentService(ctx, serviceID, scope.Namespace, scope.Partition)
+				if err != nil {
+					entry.setError(err)
+					a.metrics.Errors.WithLabelValues(errClassConsul).Inc()
+					slog.ErrorContext(ctx, "failed to verify service", "container", insp.ID, "service", svcName, "service_id", serviceID, "action", "verify", "error", err)
+				} else if diffs := diffService(svc, current); len(diffs) > 0 {
+					logDrift(insp.ID, svcName, serviceID, diffs)
+					a.metrics.Drift.WithLabelValues(svcName).Inc()
+					reason = "drift"
+				} else {
+					st.VerifiedAt[serviceID] = time.Now()
 				}
 			}
 
-			if shouldRegister {
-				b, _ := json.MarshalIndent(svc, "", "  ")
-				log.Printf("REGISTER PAYLOAD:\n%s", string(b))
+			if reason != "" {
+				slog.DebugContext(ctx, "register payload", "container", insp.ID, "service", svcName, "service_id", serviceID, "payload", redactPayload(svc))
+
+				if prevState != nil && (prevState != st || prevState.Scopes[serviceID] != scope) {
+					// Moved to another target, namespace or partition: the
+					// old registration would otherwise stay behind. Retry
+					// the move next cycle if it cannot be removed.
+					if err := a.deregister(ctx, serviceID, prevState.Scopes[serviceID]); err != nil {
+						entry.fail(statusRegisterFailed, err)
+						continue
+					}
+					deregistered[serviceID] = true
+					prevState.Forget(serviceID)
+				}
 
-				err = a.consul.RegisterService(ctx, svc)
+				err = consul.RegisterService(ctx, svc, scope.Namespace, scope.Partition)
 				if err != nil {
-					log.Printf("container=%s failed to register service=%s error=%v", insp.ID, svcName, err)
+					entry.fail(statusRegisterFailed, err)
+					a.metrics.Errors.WithLabelValues(errClassConsul).Inc()
+					a.metrics.Registrations.WithLabelValues(svcName, scope.targetName(), reason, "error").Inc()
+					slog.ErrorContext(ctx, "failed to register service", "container", insp.ID, "service", svcName, "service_id", serviceID, "action", "register", "reason", reason, "error", err)
 					continue
 				}
-
-				a.servicePayloadHash[serviceID] = payloadHash
-				a.lastRegisterAt[serviceID] = time.Now()
-				a.state.Services[serviceID] = true
-				log.Printf("container=%s registered service=%s id=%s", insp.ID, svcName, serviceID)
+				a.metrics.Registrations.WithLabelValues(svcName, scope.targetName(), reason, "success").Inc()
+
+				st.Services[serviceID] = true
+				st.setScope(serviceID, scope)
+				st.ServiceHashes[serviceID] = payloadHash
+				st.RegisteredAt[serviceID] = time.Now()
+				st.VerifiedAt[serviceID] = st.RegisteredAt[serviceID]
+				// The registration replaced the sidecar failure check, if any.
+				delete(st.SidecarChecks, serviceID)
+				slog.InfoContext(ctx, "registered service", "container", insp.ID, "service", svcName, "service_id", serviceID, "action", "register", "reason", reason)
 			} else {
-				a.state.Services[serviceID] = true
+				st.Services[serviceID] = true
+				st.setScope(serviceID, scope)
+				a.metrics.Skips.WithLabelValues(svcName, "unchanged").Inc()
+			}
+			entry.Status = statusRegistered
+			registered[svcName]++
+			ttlChecks[svcName] += countTTLChecks(svc)
+
+			if t, ok := st.RegisteredAt[serviceID]; ok {
+				entry.RegisteredAt = &t
 			}
 
 			if sidecarRequested {
+				entry.Sidecar = &SidecarStatus{Provider: provider.Kind(), State: "pending"}
 				if !a.cfg.SidecarEnabled {
-					log.Printf("container=%s sidecar requested but SIDECAR_ENABLED=false", insp.ID)
+					entry.Sidecar.State = "disabled"
+					slog.WarnContext(ctx, "sidecar requested but SIDECAR_ENABLED=false", "container", insp.ID, "service", svcName, "service_id", serviceID)
 					continue
 				}
-				if a.cfg.SidecarImage == "" || a.cfg.SidecarGrpcAddr == "" || a.cfg.SidecarHttpAddr == "" {
-					log.Printf("container=%s missing required sidecar config SIDECAR_IMAGE or GRPC/HTTP", insp.ID)
+
+				spec, err := provider.Build(SidecarRequest{
+					ParentID:      insp.ID,
+					Name:          labelName,
+					ServiceID:     serviceID,
+					Cfg:           a.cfg,
+					Scope:         scope,
+					Target:        target,
+					NeedsNetAdmin: sidecarNeedsTransparentProxy(svc),
+					Overrides:     overrides,
+				})
+				if err != nil {
+					entry.fail(statusSidecarFailed, err)
+					a.metrics.Errors.WithLabelValues(errClassSidecar).Inc()
+					slog.ErrorContext(ctx, "invalid sidecar spec", "container", insp.ID, "service", svcName, "service_id", serviceID, "error", err)
+					continue
+				}
+
+				if !insp.State.Running {
+					// The sidecar joins the parent's network namespace; wait
+					// for the parent to run again.
 					continue
 				}
 
 				if sc, ok := sidecarsByServiceID[serviceID]; ok {
+					if sc.Labels[sidecarHashLabel] != spec.Hash {
+						outdated = append(outdated, sidecarRecreate{oldID: sc.ID, spec: spec, entry: entry})
+						continue
+					}
+					if si := sidecarInspects[serviceID]; si != nil && si.State.StartedAt.Before(insp.State.StartedAt) {
+						// The parent restarted after the sidecar: the sidecar
+						// is attached to a stale network namespace, and the
+						// redirect rules are gone.
+						slog.InfoContext(ctx, "container restarted after its sidecar, recreating sidecar", "container", insp.ID, "service_id", serviceID, "sidecar", sc.ID, "action", "sidecar_recreate")
+						if err := a.docker.RecreateSidecar(ctx, sc.ID, spec); err != nil {
+							entry.fail(statusSidecarFailed, err)
+							a.metrics.Errors.WithLabelValues(errClassSidecar).Inc()
+							launched["error"]++
+							slog.ErrorContext(ctx, "sidecar recreation failed", "container", insp.ID, "service_id", serviceID, "action", "sidecar_recreate", "error", err)
+						} else {
+							launched["success"]++
+						}
+						continue
+					}
 					if sc.State != "running" {
 						_ = a.docker.StartContainer(ctx, sc.ID)
 					}
 					continue
 				}
 
-				needsNetAdmin := sidecarNeedsTransparentProxy(svc)
-				launchErr := a.docker.LaunchSidecar(ctx, insp.ID, labelName, serviceID, a.cfg, needsNetAdmin)
+				launchErr := a.docker.LaunchSidecar(ctx, spec)
 				if launchErr != nil {
-					log.Printf("container=%s sidecar failed: %v", insp.ID, launchErr)
+					entry.fail(statusSidecarFailed, launchErr)
+					a.metrics.Errors.WithLabelValues(errClassSidecar).Inc()
+					launched["error"]++
+					slog.ErrorContext(ctx, "sidecar launch failed", "container", insp.ID, "service", svcName, "service_id", serviceID, "action", "sidecar_launch", "error", launchErr)
 				} else {
-					log.Printf("container=%s sidecar launched for service=%s", insp.ID, labelName)
+					launched["success"]++
+					slog.InfoContext(ctx, "sidecar launched", "container", insp.ID, "service", svcName, "service_id", serviceID, "action", "sidecar_launch")
 				}
 			}
 		}
+		span.End()
 	}
 
-	for id := range a.state.Services {
-		if !found[id] {
-			_ = a.consul.DeregisterService(ctx, id, "", "")
-			delete(a.state.Services, id)
-			delete(a.servicePayloadHash, id)
-			delete(a.lastRegisterAt, id)
-			log.Printf("deregistered stale service id=%s", id)
+	ok, failed := a.recreateSidecars(ctx, outdated)
+	launched["success"] += ok
+	launched["error"] += failed
+	failures := a.monitorSidecars(ctx, sidecarInspects, found)
+	for sid, entry := range view {
+		if si := sidecarInspects[sid]; si != nil && entry.Sidecar != nil {
+			entry.Sidecar.fill(si, failures[sid])
+			if f := failures[sid]; f != "" {
+				entry.Status = statusSidecarFailed
+				entry.LastError = f
+			}
 		}
 	}
 
+	for _, st := range a.states {
+		for id := range st.Services {
+			if !found[id] {
+				if err := a.deregister(ctx, id, st.Scopes[id]); err == nil {
+					st.Forget(id)
+					deregistered[id] = true
+				}
+			}
+		}
+	}
+	a.syncConfigEntries(ctx, configEntries, deregistered)
+
+	deleted := map[string]int{}
 	for sid, sc := range sidecarsByServiceID {
-		if !found[sid] {
-			log.Printf("removing orphan sidecar container id=%s service-id=%s", sc.ID, sid)
-			_ = a.docker.RemoveContainer(ctx, sc.ID)
+		if !found[sid] || unwanted[sid] {
+			slog.InfoContext(ctx, "removing orphan sidecar", "sidecar", sc.ID, "service_id", sid, "action", "sidecar_remove")
+			if err := a.docker.RemoveContainer(ctx, sc.ID); err != nil {
+				a.metrics.Errors.WithLabelValues(errClassDocker).Inc()
+				deleted["error"]++
+			} else {
+				deleted["success"]++
+			}
 		}
 	}
 
-	log.Printf("reconcile complete services=%d", len(a.state.Services))
-	return SaveState(a.statePath, a.state)
+	for _, st := range a.states {
+		for sid := range st.SidecarChecks {
+			ttlChecks[serviceNameFromID(sid)]++
+		}
+	}
+	setGaugeVec(a.metrics.Services, registered)
+	setGaugeVec(a.metrics.TTLChecks, ttlChecks)
+	for _, outcome := range []string{"success", "error"} {
+		a.metrics.SidecarsLaunched.WithLabelValues(outcome).Set(float64(launched[outcome]))
+		a.metrics.SidecarsDeleted.WithLabelValues(outcome).Set(float64(deleted[outcome]))
+	}
+
+	a.publish(view, rejected)
+	span.SetAttributes(attribute.Int("services", a.serviceCount()))
+	slog.InfoContext(ctx, "reconcile complete", "action", "reconcile", "services", a.serviceCount(), "duration", time.Since(start))
+	return a.saveStates(ctx)
+}
+
+// saveStates saves the state of every target. A target whose state cannot
+// be saved does not prevent saving the others.
+func (a *Agent) saveStates(ctx context.Context) error {
+	var errs []error
+	for _, name := range sortedKeys(a.states) {
+		store, ok := a.stores[name]
+		if !ok {
+			continue
+		}
+		if err := store.Save(ctx, a.states[name]); err != nil {
+			a.metrics.Errors.WithLabelValues(errClassState).Inc()
+			errs = append(errs, fmt.Errorf("target %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// keepRegistration reports an invalid auxiliary label (target, sidecar,
+// upstreams or config entry) of a service whose own label is valid. The
+// service is marked found, so its previous registration and sidecar stay as
+// they are until the label is fixed, but it is not re-registered.
+func (a *Agent) keepRegistration(ctx context.Context, found map[string]bool, entry *ManagedService, status, label string, err error) {
+	found[entry.ID] = true
+	entry.fail(status, err)
+	a.metrics.Errors.WithLabelValues(errClassLabel).Inc()
+	a.metrics.Skips.WithLabelValues(entry.Name, "invalid_label").Inc()
+	slog.ErrorContext(ctx, "invalid label, keeping the previous registration", "container", entry.ContainerID, "service", entry.Name, "service_id", entry.ID, "label", label, "error", err)
+}
+
+// deregister removes a service from the target, namespace and partition it
+// was registered in. A service the agent does not know is already gone.
+// On error the service must be kept in the state, to be retried.
+func (a *Agent) deregister(ctx context.Context, serviceID string, scope ConsulScope) error {
+	name := serviceNameFromID(serviceID)
+	consul, err := a.client(scope)
+	if err == nil {
+		err = consul.DeregisterService(ctx, serviceID, scope.Namespace, scope.Partition)
+	}
+	if err != nil && !isNotFound(err) {
+		a.metrics.Errors.WithLabelValues(errClassConsul).Inc()
+		a.metrics.Deregistrations.WithLabelValues(name, scope.targetName(), "error").Inc()
+		slog.ErrorContext(ctx, "failed to deregister service", "service", name, "service_id", serviceID, "target", scope.targetName(), "action", "deregister", "error", err)
+		return err
+	}
+	a.metrics.Deregistrations.WithLabelValues(name, scope.targetName(), "success").Inc()
+	slog.InfoContext(ctx, "deregistered service", "service", name, "service_id", serviceID, "target", scope.targetName(), "action", "deregister", "already_gone", err != nil)
+	return nil
+}
+
+// liveServices lists the services registered by consul-registrator with
+// every target, in its default scope and in every scope the state knows
+// about. Services registered by others are left out, so a foreign service
+// reusing a managed ID shows up as missing.
+func (a *Agent) liveServices(ctx context.Context) (map[string]AgentServiceInfo, error) {
+	scopes := map[ConsulScope]bool{}
+	for _, name := range a.cfg.targetNames() {
+		t, _ := a.cfg.target(name)
+		scopes[t.scope()] = true
+	}
+	for _, st := range a.states {
+		for _, s := range st.Scopes {
+			scopes[s] = true
+		}
+	}
+
+	live := map[string]AgentServiceInfo{}
+	for s := range scopes {
+		consul, err := a.client(s)
+		if err != nil {
+			// A target removed from the config: nothing to compare with.
+			continue
+		}
+		services, err := consul.AgentServices(ctx, s.Namespace, s.Partition)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", s.targetName(), err)
+		}
+		for id, info := range services {
+			if ownedService(info) {
+				live[id] = info
+			}
+		}
+	}
+	return live, nil
+}
+
+// serviceScope returns the namespace and partition of a service payload,
+// falling back to def, and normalizes them to the lowercase keys.
+func serviceScope(svc map[string]any, def ConsulScope) ConsulScope {
+	scope := def
+	for _, k := range []string{"Namespace", "namespace"} {
+		if v, ok := svc[k].(string); ok {
+			scope.Namespace = v
+			delete(svc, k)
+		}
+	}
+	for _, k := range []string{"Partition", "partition"} {
+		if v, ok := svc[k].(string); ok {
+			scope.Partition = v
+			delete(svc, k)
+		}
+	}
+	if scope.Namespace != "" {
+		svc["namespace"] = scope.Namespace
+	}
+	if scope.Partition != "" {
+		svc["partition"] = scope.Partition
+	}
+	return scope
+}
+
+// reregisterInterval is how often registrations are verified.
+func (a *Agent) reregisterInterval() time.Duration {
+	if a.cfg.ReRegisterInterval <= 0 {
+		return defaultReRegisterInterval
+	}
+	return a.cfg.ReRegisterInterval
+}
+
+// verifyDue reports whether the registration of serviceID should be checked
+// against the Consul agent. Each service gets a stable offset within the
+// jitter window so checks are spread over time instead of happening in the
+// same cycle.
+func (a *Agent) verifyDue(st *State, serviceID string) bool {
+	interval := a.reregisterInterval()
+
+	last := st.VerifiedAt[serviceID]
+	if last.IsZero() {
+		last = st.RegisteredAt[serviceID]
+	}
+	return time.Since(last) >= interval+serviceJitter(serviceID, a.cfg.ReRegisterJitter)
+}
+
+func serviceJitter(serviceID string, max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(serviceID))
+	return time.Duration(h.Sum64() % uint64(max))
+}
+
+func stringsFromAny(v any) []string {
+	switch x := v.(type) {
+	case []string:
+		return x
+	case []any:
+		out := make([]string, 0, len(x))
+		for _, it := range x {
+			if s, ok := it.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+type sidecarRecreate struct {
+	oldID string
+	spec  *SidecarSpec
+	entry *ManagedService
+}
+
+// recreateSidecars replaces sidecars whose spec changed. At most
+// SidecarRecreateConcurrency sidecars are recreated per cycle, in parallel;
+// the rest are picked up by the next cycles, which rolls the change out
+// gradually.
+func (a *Agent) recreateSidecars(ctx context.Context, outdated []sidecarRecreate) (ok, failed int) {
+	if len(outdated) == 0 {
+		return 0, 0
+	}
+
+	limit := int(a.cfg.SidecarRecreateConcurrency)
+	if limit < 1 {
+		limit = 1
+	}
+	if len(outdated) > limit {
+		slog.InfoContext(ctx, "sidecar recreation limited", "outdated", len(outdated), "recreating", limit)
+		outdated = outdated[:limit]
+	}
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for _, r := range outdated {
+		wg.Add(1)
+		go func(r sidecarRecreate) {
+			defer wg.Done()
+			slog.InfoContext(ctx, "recreating sidecar", "sidecar", r.oldID, "service_id", r.spec.ServiceID, "hash", r.spec.Hash, "action", "sidecar_recreate")
+			err := a.docker.RecreateSidecar(ctx, r.oldID, r.spec)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				r.entry.fail(statusSidecarFailed, err)
+				a.metrics.Errors.WithLabelValues(errClassSidecar).Inc()
+				failed++
+				slog.ErrorContext(ctx, "sidecar recreation failed", "service_id", r.spec.ServiceID, "action", "sidecar_recreate", "error", err)
+				return
+			}
+			ok++
+		}(r)
+	}
+	wg.Wait()
+	return ok, failed
+}
+
+// inspect wraps DockerClient.Inspect with the latency and error metrics.
+func (a *Agent) inspect(ctx context.Context, id string) (*DockerInspect, error) {
+	start := time.Now()
+	insp, err := a.docker.Inspect(ctx, id)
+	a.metrics.DockerInspectDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		a.metrics.Errors.WithLabelValues(errClassDocker).Inc()
+	}
+	return insp, err
+}
+
+// setGaugeVec replaces the values of g with counts, so label values absent
+// from this cycle disappear instead of keeping their last value.
+func setGaugeVec(g *prometheus.GaugeVec, counts map[string]int) {
+	g.Reset()
+	for k, n := range counts {
+		g.WithLabelValues(k).Set(float64(n))
+	}
+}
+
+// countTTLChecks counts the TTL checks declared in a service payload,
+// including those of its sidecar_service.
+func countTTLChecks(svc map[string]any) int {
+	n := 0
+	count := func(m map[string]any) {
+		var checks []any
+		if raw, ok := m["checks"].([]any); ok {
+			checks = raw
+		} else if one, ok := m["check"].(map[string]any); ok {
+			checks = []any{one}
+		}
+		for _, c := range checks {
+			cm, _ := c.(map[string]any)
+			if _, ok := cm["TTL"]; ok {
+				n++
+			} else if _, ok := cm["ttl"]; ok {
+				n++
+			}
+		}
+	}
+	count(svc)
+	if connect, ok := svc["connect"].(map[string]any); ok {
+		if sidecar, ok := connect["sidecar_service"].(map[string]any); ok {
+			count(sidecar)
+		}
+	}
+	return n
+}
+
+// serviceNameFromID returns the service name part of an ID built by
+// makeServiceID.
+func serviceNameFromID(id string) string {
+	if i := strings.LastIndex(id, ":"); i > 0 {
+		return id[:i]
+	}
+	return id
 }
 
 func hashServicePayload(svc map[string]any) string {
@@ -238,16 +881,22 @@ func isLoopbackHost(host string) bool {
 	return h == "127.0.0.1" || h == "localhost" || h == "::1"
 }
 
-func isReservedSidecarPort(p int) bool {
+// isReservedSidecarPort reports whether the sidecar of a service with the
+// given overrides (nil for none) listens on p: the transparent proxy ports,
+// and the Envoy admin and ready ports in effect.
+func isReservedSidecarPort(p int, ov *SidecarOverrides) bool {
 	switch p {
-	case 15000, 15001, 15002, 15090, 19000, 19100:
+	case 15000, 15001, 15002, 15090, ov.envoyAdminPort(), ov.envoyReadyPort():
 		return true
 	default:
 		return false
 	}
 }
 
-func applySidecarAutoAndProm(svc map[string]any, serviceName, serviceID string, cfg *Config, sidecarRequested bool) {
+// applySidecarAutoAndProm expands `auto = true` in sidecar_service into the
+// default sidecar checks. readyPort is the proxy's ready endpoint, 0 if none;
+// ov the service's sidecar overrides, nil if none.
+func applySidecarAutoAndProm(svc map[string]any, serviceName, serviceID string, cfg *Config, sidecarRequested bool, readyPort int, ov *SidecarOverrides) {
 	connect, ok := svc["connect"].(map[string]any)
 	if !ok {
 		return
@@ -307,10 +956,10 @@ func applySidecarAutoAndProm(svc map[string]any, serviceName, serviceID string,
 	}
 
 	if auto {
-		if !hasReady {
+		if !hasReady && readyPort != 0 {
 			checks = append(checks, map[string]any{
 				"Name":     "Envoy Ready",
-				"HTTP":     "http://" + checkHost + ":19100/ready",
+				"HTTP":     fmt.Sprintf("http://%s:%d/ready", checkHost, readyPort),
 				"Interval": "10s",
 				"Timeout":  "2s",
 			})
@@ -319,13 +968,13 @@ func applySidecarAutoAndProm(svc map[string]any, serviceName, serviceID string,
 		if !hasMetrics && sidecarRequested && cfg != nil && strings.TrimSpace(cfg.SidecarPrometheusBindAddr) != "" {
 			host, port, err := parseHostPort(cfg.SidecarPrometheusBindAddr)
 			if err != nil {
-				log.Printf("service=%s invalid SIDECAR_PROMETHEUS_BIND_ADDR=%q (skip metrics check): %v", serviceName, cfg.SidecarPrometheusBindAddr, err)
+				slog.Warn("invalid SIDECAR_PROMETHEUS_BIND_ADDR, skipping metrics check", "service", serviceName, "bind", cfg.SidecarPrometheusBindAddr, "error", err)
 			} else if !isValidPort(port) {
-				log.Printf("service=%s invalid metrics port=%d from SIDECAR_PROMETHEUS_BIND_ADDR=%q (skip metrics check)", serviceName, port, cfg.SidecarPrometheusBindAddr)
+				slog.Warn("invalid metrics port in SIDECAR_PROMETHEUS_BIND_ADDR, skipping metrics check", "service", serviceName, "bind", cfg.SidecarPrometheusBindAddr, "port", port)
 			} else if isLoopbackHost(host) {
-				log.Printf("service=%s metrics bind addr=%q is loopback (skip metrics check; not reachable by Consul)", serviceName, cfg.SidecarPrometheusBindAddr)
-			} else if isReservedSidecarPort(port) {
-				log.Printf("service=%s metrics port=%d collides with reserved ports (skip metrics check) bind=%q", serviceName, port, cfg.SidecarPrometheusBindAddr)
+				slog.Warn("metrics bind addr is loopback and not reachable by Consul, skipping metrics check", "service", serviceName, "bind", cfg.SidecarPrometheusBindAddr)
+			} else if isReservedSidecarPort(port, ov) {
+				slog.Warn("metrics port collides with reserved ports, skipping metrics check", "service", serviceName, "bind", cfg.SidecarPrometheusBindAddr, "port", port)
 			} else {
 				checks = append(checks, map[string]any{
 					"Name":     "Envoy Metrics",
@@ -354,13 +1003,13 @@ func applySidecarAutoAndProm(svc map[string]any, serviceName, serviceID string,
 	if sidecarRequested && cfg != nil && strings.TrimSpace(cfg.SidecarPrometheusBindAddr) != "" {
 		host, port, err := parseHostPort(cfg.SidecarPrometheusBindAddr)
 		if err != nil {
-			log.Printf("service=%s skip envoy_prometheus_bind_addr=%q (invalid host:port): %v", serviceName, cfg.SidecarPrometheusBindAddr, err)
+			slog.Warn("skipping envoy_prometheus_bind_addr: invalid host:port", "service", serviceName, "bind", cfg.SidecarPrometheusBindAddr, "error", err)
 		} else if !isValidPort(port) {
-			log.Printf("service=%s skip envoy_prometheus_bind_addr=%q (invalid port=%d)", serviceName, cfg.SidecarPrometheusBindAddr, port)
+			slog.Warn("skipping envoy_prometheus_bind_addr: invalid port", "service", serviceName, "bind", cfg.SidecarPrometheusBindAddr, "port", port)
 		} else if isLoopbackHost(host) {
-			log.Printf("service=%s skip envoy_prometheus_bind_addr=%q (loopback; not reachable by Consul)", serviceName, cfg.SidecarPrometheusBindAddr)
-		} else if isReservedSidecarPort(port) {
-			log.Printf("service=%s skip envoy_prometheus_bind_addr=%q (reserved port=%d)", serviceName, cfg.SidecarPrometheusBindAddr, port)
+			slog.Warn("skipping envoy_prometheus_bind_addr: loopback is not reachable by Consul", "service", serviceName, "bind", cfg.SidecarPrometheusBindAddr)
+		} else if isReservedSidecarPort(port, ov) {
+			slog.Warn("skipping envoy_prometheus_bind_addr: reserved port", "service", serviceName, "bind", cfg.SidecarPrometheusBindAddr, "port", port)
 		} else {
 			ensureEnvoyPrometheus(sidecar, cfg.SidecarPrometheusBindAddr)
 		}
@@ -522,7 +1171,7 @@ func sidecarNeedsTransparentProxy(svc map[string]any) bool {
 	return false
 }
 
-func applyAutoTCPCheckOnServiceOrEnvoy(svc map[string]any, serviceName string) {
+func applyAutoTCPCheckOnServiceOrEnvoy(svc map[string]any, serviceName string, ov *SidecarOverrides) {
 	host := serviceName
 	if addr, ok := svc["address"].(string); ok && addr != "" {
 		host = addr
@@ -544,7 +1193,7 @@ func applyAutoTCPCheckOnServiceOrEnvoy(svc map[string]any, serviceName string) {
 		if port < 1 || port > 65535 {
 			return
 		}
-		if isReservedSidecarPort(port) {
+		if isReservedSidecarPort(port, ov) {
 			return
 		}
 		checkPort = port
@@ -576,10 +1225,10 @@ func applyAutoTCPCheckOnServiceOrEnvoy(svc map[string]any, serviceName string) {
 	}
 
 	checks = append(checks, map[string]any{
-		"Name":     checkName,
-		"TCP":      fmt.Sprintf("%s:%d", host, checkPort),
-		"Interval": "10s",
-		"Timeout":  "2s",
+		"Name":                   checkName,
+		"TCP":                    fmt.Sprintf("%s:%d", host, checkPort),
+		"Interval":               "10s",
+		"Timeout":                "2s",
 		"Status":                 "passing",
 		"FailuresBeforeCritical": 6,
 		"SuccessBeforePassing":   1,
@@ -608,7 +1257,10 @@ func intFromAny(v any) int {
 	}
 }
 
-func injectTagsAndMeta(svc map[string]any, insp *DockerInspect, sidecarRequested bool, cfg *Config, serviceID string) {
+// injectTagsAndMeta records the registrator's bookkeeping marks on the
+// service and its sidecar_service: in their meta, and also as tags when
+// LegacyTags is set.
+func injectTagsAndMeta(svc map[string]any, insp *DockerInspect, sidecarRequested bool, cfg *Config, serviceID, proxyKind string) {
 	readTags := func(v any) []string {
 		switch x := v.(type) {
 		case []string:
@@ -661,7 +1313,24 @@ func injectTagsAndMeta(svc map[string]any, insp *DockerInspect, sidecarRequested
 		return out
 	}
 
-	existingSvcTags := readTags(svc["Tags"])
+	// apply records the bookkeeping marks ("key=value") of m in its meta
+	// and, in legacy mode, also as tags, under the tags key m already uses.
+	apply := func(m map[string]any, tagsKey string, marks []string) {
+		for _, k := range []string{"Tags", "tags"} {
+			if _, ok := m[k]; ok {
+				tagsKey = k
+			}
+		}
+		meta := make(map[string]string, len(marks))
+		for _, mark := range marks {
+			k, v, _ := strings.Cut(mark, "=")
+			meta[bookkeepingMetaKey(k)] = v
+		}
+		mergeMeta(m, meta, true)
+		if cfg != nil && cfg.LegacyTags {
+			m[tagsKey] = mergeTags(readTags(m[tagsKey]), marks...)
+		}
+	}
 
 	inject := []string{
 		"consul-registrator.managed=true",
@@ -701,7 +1370,7 @@ func injectTagsAndMeta(svc map[string]any, insp *DockerInspect, sidecarRequested
 		inject = append(inject, "consul-registrator.proxy.enabled=false")
 	}
 
-	svc["Tags"] = mergeTags(existingSvcTags, inject...)
+	apply(svc, "Tags", inject)
 
 	connect, _ := svc["connect"].(map[string]any)
 	if connect == nil {
@@ -712,11 +1381,9 @@ func injectTagsAndMeta(svc map[string]any, insp *DockerInspect, sidecarRequested
 		return
 	}
 
-	existingSidecarTags := readTags(sidecar["tags"])
-
 	sidecarInject := []string{
 		"consul-registrator.managed=true",
-		"consul-registrator.proxy=envoy",
+		"consul-registrator.proxy=" + proxyKind,
 	}
 	if sidecarNeedsTransparentProxy(svc) {
 		sidecarInject = append(sidecarInject, "consul-registrator.transparent-proxy.enabled=true")
@@ -738,11 +1405,63 @@ func injectTagsAndMeta(svc map[string]any, insp *DockerInspect, sidecarRequested
 		sidecarInject = append(sidecarInject, "consul-registrator.metrics.sidecar=enabled")
 	}
 
-	sidecar["tags"] = mergeTags(existingSidecarTags, sidecarInject...)
+	apply(sidecar, "tags", sidecarInject)
 }
 
-func makeServiceID(containerID, svcName string) string {
+// parseServiceLabel parses a service label. A service without a name, or an
+// empty label, is named after the label; a Name set in the Consul API casing
+// is moved to name.
+func parseServiceLabel(value, labelName string) (*ServiceLabel, error) {
+	if strings.TrimSpace(value) == "" {
+		return &ServiceLabel{Service: map[string]any{"name": labelName}}, nil
+	}
+	parsed, err := ParseServiceHCL(value)
+	if err != nil {
+		return nil, err
+	}
+	if name, ok := parsed.Service["Name"]; ok {
+		if _, ok := parsed.Service["name"]; ok {
+			return nil, fmt.Errorf("service sets both name and Name")
+		}
+		parsed.Service["name"] = name
+		delete(parsed.Service, "Name")
+	}
+	if _, ok := parsed.Service["name"]; !ok {
+		parsed.Service["name"] = labelName
+	}
+	return parsed, nil
+}
+
+// mergeMeta adds meta to the meta of a service definition. Keys already set,
+// e.g. in the label, win unless override is set.
+func mergeMeta(m map[string]any, meta map[string]string, override bool) {
+	if len(meta) == 0 {
+		return
+	}
+	key := "meta"
+	if _, ok := m["Meta"]; ok {
+		key = "Meta"
+	}
+	out := map[string]any{}
+	for k, v := range stringMapFromAny(m[key]) {
+		out[k] = v
+	}
+	for k, v := range meta {
+		if _, set := out[k]; override || !set {
+			out[k] = v
+		}
+	}
+	m[key] = out
+}
+
+// makeServiceID derives a stable service ID from the container and service
+// name. Instances with a non-default label prefix hash it with the container
+// ID so their IDs, and sidecar names, do not collide.
+func makeServiceID(labelPrefix, containerID, svcName string) string {
 	cid := strings.TrimSpace(containerID)
+	if labelPrefix != defaultLabelPrefix {
+		cid = labelPrefix + "/" + cid
+	}
 
 	sum := sha256.Sum256([]byte(cid))
 	short := hex.EncodeToString(sum[:])[:9]
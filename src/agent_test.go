@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	testMetricsOnce sync.Once
+	testMetricsVal  *Metrics
+)
+
+// testMetrics returns the metrics shared by the tests: NewMetrics registers
+// them with the default registry, which only accepts them once.
+func testMetrics() *Metrics {
+	testMetricsOnce.Do(func() { testMetricsVal = NewMetrics() })
+	return testMetricsVal
+}
+
+var (
+	testSpansOnce sync.Once
+	testSpans     *tracetest.InMemoryExporter
+)
+
+// recordSpans installs an in-memory span exporter as the global tracer
+// provider, once, and returns it emptied.
+func recordSpans() *tracetest.InMemoryExporter {
+	testSpansOnce.Do(func() {
+		testSpans = tracetest.NewInMemoryExporter()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(testSpans)))
+	})
+	testSpans.Reset()
+	return testSpans
+}
+
+// fakeDocker serves a Docker Engine API with one container running web.
+func fakeDocker(t *testing.T) *DockerClient {
+	t.Helper()
+	return fakeDockerWith(t, map[string]string{
+		"consul.service.web": "service {\n  name = \"web\"\n  port = 80\n}",
+	})
+}
+
+// fakeDockerWith serves a Docker Engine API with one container carrying
+// labels.
+func fakeDockerWith(t *testing.T, labels map[string]string) *DockerClient {
+	t.Helper()
+	inspect := map[string]any{
+		"Id":    "abc123",
+		"Name":  "/web-1",
+		"Image": "sha256:img",
+		"Config": map[string]any{
+			"Image":  "nginx:1.27",
+			"Labels": labels,
+		},
+		"State": map[string]any{"Status": "running", "Running": true},
+		"NetworkSettings": map[string]any{
+			"Networks": map[string]any{"bridge": map[string]any{"IPAddress": "172.17.0.2"}},
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Query().Get("filters"), "sidecar") {
+			_, _ = w.Write([]byte("[]"))
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]map[string]any{{"Id": "abc123", "State": "running", "Labels": labels}})
+	})
+	mux.HandleFunc("/containers/abc123/json", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(inspect)
+	})
+	mux.HandleFunc("/images/sha256:img/json", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"RepoDigests": []string{"nginx@sha256:0123"}})
+	})
+
+	sock := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &httptest.Server{Listener: l, Config: &http.Server{Handler: mux}}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return NewDockerClient(sock, 5*time.Second)
+}
+
+// fakeConsul serves the agent endpoints used by a reconcile and records the
+// registered payloads.
+type fakeConsul struct {
+	mu         sync.Mutex
+	registered []map[string]any
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/agent/services":
+		_, _ = w.Write([]byte("{}"))
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/agent/service/register":
+		var svc map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&svc)
+		f.mu.Lock()
+		f.registered = append(f.registered, svc)
+		f.mu.Unlock()
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestAgent(t *testing.T, consul http.Handler) *Agent {
+	t.Helper()
+	return newTestAgentTargets(t, map[string]http.Handler{defaultTarget: consul})
+}
+
+// newTestAgentTargets returns an agent with a Consul target served by each
+// handler, and file state stores in a temporary directory.
+func newTestAgentTargets(t *testing.T, consuls map[string]http.Handler) *Agent {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.StatePath = filepath.Join(t.TempDir(), "state.json")
+	targets := map[string]*ConsulClient{}
+	for name, h := range consuls {
+		srv := httptest.NewServer(h)
+		t.Cleanup(srv.Close)
+		if name == defaultTarget {
+			cfg.ConsulAddr = srv.URL
+		} else {
+			if cfg.Targets == nil {
+				cfg.Targets = map[string]ConsulTarget{}
+			}
+			cfg.Targets[name] = ConsulTarget{Name: name, Address: srv.URL}
+		}
+		targets[name] = NewConsulClient(srv.URL, "", 5*time.Second, false)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	stores, err := newStateStores(targets, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAgent(fakeDocker(t), targets, testMetrics(), NewHealth(time.Minute), loadStates(stores), stores, cfg)
+}
+
+func TestRunTracesReconcile(t *testing.T) {
+	spans := recordSpans()
+	var logs bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(traceHandler{slog.NewJSONHandler(&logs, nil)}))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	consul := &fakeConsul{}
+	a := newTestAgent(t, consul)
+	if err := a.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(consul.registered) != 1 {
+		t.Fatalf("registered %d services, want 1", len(consul.registered))
+	}
+
+	byName := map[string][]tracetest.SpanStub{}
+	for _, s := range spans.GetSpans() {
+		byName[s.Name] = append(byName[s.Name], s)
+	}
+	if len(byName["reconcile"]) != 1 || len(byName["container"]) != 1 {
+		t.Fatalf("spans = %v, want one reconcile and one container span", byName)
+	}
+	root, container := byName["reconcile"][0], byName["container"][0]
+	if root.Parent.IsValid() {
+		t.Errorf("reconcile span has parent %s", root.Parent.SpanID())
+	}
+	if container.Parent.SpanID() != root.SpanContext.SpanID() {
+		t.Errorf("container span parent = %s, want reconcile", container.Parent.SpanID())
+	}
+
+	parents := map[string]bool{
+		root.SpanContext.SpanID().String():      true,
+		container.SpanContext.SpanID().String(): true,
+	}
+	for _, name := range []string{"docker.request", "consul.request"} {
+		if len(byName[name]) == 0 {
+			t.Errorf("no %s span", name)
+		}
+		for _, s := range byName[name] {
+			if s.SpanContext.TraceID() != root.SpanContext.TraceID() || !parents[s.Parent.SpanID().String()] {
+				t.Errorf("%s span %s is not a child of the reconcile or container span", name, s.SpanContext.SpanID())
+			}
+		}
+	}
+
+	var registered map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		if rec["msg"] == "registered service" {
+			registered = rec
+		}
+	}
+	if registered == nil {
+		t.Fatalf("no registered service log in %s", logs.String())
+	}
+	if registered["trace_id"] != root.SpanContext.TraceID().String() || registered["span_id"] != container.SpanContext.SpanID().String() {
+		t.Errorf("log trace_id=%v span_id=%v, want %s/%s", registered["trace_id"], registered["span_id"], root.SpanContext.TraceID(), container.SpanContext.SpanID())
+	}
+
+	if _, err := os.Stat(a.cfg.StatePath); err != nil {
+		t.Errorf("state not saved: %v", err)
+	}
+}
+
+func TestMakeServiceID(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefix   string
+		cid      string
+		svc      string
+		sameAs   [3]string // prefix, container, service of an equal ID, if set
+		differTo [3]string // prefix, container, service of a different ID, if set
+	}{
+		{name: "default prefix", prefix: "consul", cid: "abc123", svc: "web", sameAs: [3]string{"consul", " abc123 ", "web"}, differTo: [3]string{"dc2", "abc123", "web"}},
+		{name: "other prefixes differ", prefix: "dc2", cid: "abc123", svc: "web", differTo: [3]string{"dc3", "abc123", "web"}},
+		{name: "containers differ", prefix: "dc2", cid: "abc123", svc: "web", differTo: [3]string{"dc2", "abc124", "web"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := makeServiceID(tt.prefix, tt.cid, tt.svc)
+			if !strings.HasPrefix(id, tt.svc+":") || len(id) != len(tt.svc)+1+9 {
+				t.Errorf("makeServiceID() = %q, want <service>:<9 hex digits>", id)
+			}
+			if tt.sameAs[0] != "" {
+				if other := makeServiceID(tt.sameAs[0], tt.sameAs[1], tt.sameAs[2]); other != id {
+					t.Errorf("makeServiceID%q = %q, want %q", tt.sameAs, other, id)
+				}
+			}
+			if other := makeServiceID(tt.differTo[0], tt.differTo[1], tt.differTo[2]); other == id {
+				t.Errorf("makeServiceID%q = %q, same as %q", tt.differTo, other, id)
+			}
+		})
+	}
+
+	// IDs of the default prefix are the ones of earlier versions.
+	if got, want := makeServiceID("consul", "abc123", "web"), "web:6ca13d52c"; got != want {
+		t.Errorf("makeServiceID() = %q, want %q", got, want)
+	}
+}
+
+func TestParseServiceLabel(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		wantName any
+		wantErr  bool
+	}{
+		{name: "empty label", value: " ", wantName: "web"},
+		{name: "empty block", value: "service {}", wantName: "web"},
+		{name: "port only", value: "service { port = 80 }", wantName: "web"},
+		{name: "explicit name", value: `service { name = "api" }`, wantName: "api"},
+		{name: "capitalized name", value: `service { Name = "web" }`, wantName: "web"},
+		{name: "both names", value: "service {\n  name = \"web\"\n  Name = \"web\"\n}", wantErr: true},
+		{name: "invalid", value: "service {", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseServiceLabel(tt.value, "web")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Service["name"] != tt.wantName {
+				t.Errorf("service = %v, want name %v", got.Service, tt.wantName)
+			}
+			if _, ok := got.Service["Name"]; ok {
+				t.Errorf("service = %v, Name left next to name", got.Service)
+			}
+		})
+	}
+}
+
+func TestRunServiceDefaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		wantTags []any
+	}{
+		{
+			name:     "capitalized name",
+			labels:   map[string]string{"consul.service.web": "service {\n  Name = \"web\"\n  port = 80\n}"},
+			wantTags: []any{"1.27"},
+		},
+		{
+			name: "compose service",
+			labels: map[string]string{
+				"consul.service.web": "",
+				composeProjectLabel:  "shop",
+				composeServiceLabel:  "web",
+			},
+			wantTags: []any{"shop", "1.27"},
+		},
+		{
+			name:     "label tags",
+			labels:   map[string]string{"consul.service.web": "service {\n  tags = [\"blue\"]\n}", composeProjectLabel: "shop"},
+			wantTags: []any{"blue"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consul := &fakeConsul{}
+			a := newTestAgent(t, consul)
+			a.docker = fakeDockerWith(t, tt.labels)
+			if err := a.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if len(consul.registered) != 1 {
+				t.Fatalf("registered %d services, want 1", len(consul.registered))
+			}
+			svc := consul.registered[0]
+			if svc["name"] != "web" {
+				t.Errorf("registered name = %v, want web", svc["name"])
+			}
+			if !reflect.DeepEqual(svc["tags"], tt.wantTags) {
+				t.Errorf("registered tags = %v, want %v", svc["tags"], tt.wantTags)
+			}
+		})
+	}
+}
+
+func TestRunPerTargetState(t *testing.T) {
+	def, dc2 := &fakeConsul{}, &fakeConsul{}
+	var dc2Down atomic.Bool
+	a := newTestAgentTargets(t, map[string]http.Handler{
+		defaultTarget: def,
+		"dc2": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if dc2Down.Load() {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			dc2.ServeHTTP(w, r)
+		}),
+	})
+	labels := map[string]string{
+		"consul.service.web": "",
+		"consul.service.api": "",
+		"consul.target.api":  "dc2",
+	}
+	a.docker = fakeDockerWith(t, labels)
+	web, api := makeServiceID("consul", "abc123", "web"), makeServiceID("consul", "abc123", "api")
+
+	if err := a.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(def.registered) != 1 || def.registered[0]["name"] != "web" || len(dc2.registered) != 1 || dc2.registered[0]["name"] != "api" {
+		t.Fatalf("registered default=%v dc2=%v, want web and api", def.registered, dc2.registered)
+	}
+	files := map[string]string{web: a.cfg.StatePath, api: targetStatePath(a.cfg.StatePath, "dc2")}
+	for id, path := range files {
+		st, err := LoadState(path)
+		if err != nil || len(st.Services) != 1 || !st.Services[id] {
+			t.Errorf("%s: services = %v, %v, want only %s", path, st.Services, err, id)
+		}
+	}
+
+	// With dc2 down, the service removed from it stays in its state until
+	// it can be deregistered, and web is left alone.
+	dc2Down.Store(true)
+	delete(labels, "consul.service.api")
+	delete(labels, "consul.target.api")
+	a.docker = fakeDockerWith(t, labels)
+	_ = a.Run(context.Background())
+	if !a.states["dc2"].Services[api] {
+		t.Errorf("dc2 services = %v, want %s kept while dc2 is down", a.states["dc2"].Services, api)
+	}
+	if len(def.registered) != 1 || !a.states[defaultTarget].Services[web] {
+		t.Errorf("web was re-registered or forgotten: %d registrations, services %v", len(def.registered), a.states[defaultTarget].Services)
+	}
+	if st, err := LoadState(a.cfg.StatePath); err != nil || !st.Services[web] || st.Services[api] {
+		t.Errorf("default state file = %v, %v, want only %s", st.Services, err, web)
+	}
+
+	dc2Down.Store(false)
+	if err := a.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.states["dc2"].Services) != 0 {
+		t.Errorf("dc2 services = %v, want none once deregistered", a.states["dc2"].Services)
+	}
+}
+
+func TestRunUpstreamsWithoutSidecar(t *testing.T) {
+	consul := &fakeConsul{}
+	a := newTestAgent(t, consul)
+	a.docker = fakeDockerWith(t, map[string]string{
+		"consul.service.web":   "service {\n  port = 80\n}",
+		"consul.upstreams.web": "db:5432",
+	})
+	if err := a.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(consul.registered) != 0 {
+		t.Fatalf("registered %v, want nothing", consul.registered)
+	}
+	if len(a.containers) != 1 || a.containers[0].Status != statusValidationError || !strings.Contains(a.containers[0].Message, "upstreams need a sidecar") {
+		t.Errorf("containers = %+v, want a validation error about the sidecar", a.containers)
+	}
+}
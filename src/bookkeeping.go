@@ -0,0 +1,44 @@
+package main
+
+import "strings"
+
+// bookkeepingTagPrefix starts the tags older versions wrote on every
+// service, e.g. "consul-registrator.managed=true". They are written only
+// with LegacyTags; the same marks are always kept in the service meta.
+const bookkeepingTagPrefix = "consul-registrator."
+
+// managedMetaKey marks the services registered by consul-registrator.
+const managedMetaKey = "registrator-managed"
+
+// bookkeepingMetaKey returns the meta key of a bookkeeping mark, e.g.
+// "registrator-proxy-service-id" for "consul-registrator.proxy.service-id".
+// Meta keys may not contain dots, and the "consul-" prefix is reserved.
+func bookkeepingMetaKey(tagKey string) string {
+	k := strings.TrimPrefix(tagKey, bookkeepingTagPrefix)
+	return "registrator-" + strings.ReplaceAll(k, ".", "-")
+}
+
+// ownedService reports whether a service held by the Consul agent was
+// registered by consul-registrator, by its meta or, for registrations made
+// before the marks moved there, its tags.
+func ownedService(info AgentServiceInfo) bool {
+	if info.Meta[managedMetaKey] == "true" {
+		return true
+	}
+	for _, t := range info.Tags {
+		if t == bookkeepingTagPrefix+"managed=true" {
+			return true
+		}
+	}
+	return false
+}
+
+// hasLegacyTags reports whether tags hold bookkeeping marks.
+func hasLegacyTags(tags []string) bool {
+	for _, t := range tags {
+		if strings.HasPrefix(t, bookkeepingTagPrefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// Labels set by Docker Compose on the containers it creates.
+const (
+	composeProjectLabel         = "com.docker.compose.project"
+	composeServiceLabel         = "com.docker.compose.service"
+	composeContainerNumberLabel = "com.docker.compose.container-number"
+	composeVersionLabel         = "com.docker.compose.version"
+)
+
+// maxImageDigests bounds the image digest cache; it is emptied when full.
+const maxImageDigests = 256
+
+// containerMeta returns the service meta describing the container: its
+// Compose project, service, container number and version, and its image
+// name, tag and digest. Empty values are left out.
+func containerMeta(insp *DockerInspect, digest string) map[string]string {
+	meta := map[string]string{}
+	set := func(k, v string) {
+		if v = strings.TrimSpace(v); v != "" {
+			meta[k] = v
+		}
+	}
+	if insp == nil {
+		return meta
+	}
+
+	labels := insp.Config.Labels
+	set("compose-project", labels[composeProjectLabel])
+	set("compose-service", labels[composeServiceLabel])
+	set("compose-container-number", labels[composeContainerNumberLabel])
+	set("compose-version", labels[composeVersionLabel])
+
+	name, tag, refDigest := parseImageRef(insp.Config.Image)
+	if digest == "" {
+		digest = refDigest
+	}
+	set("image-name", name)
+	set("image-tag", tag)
+	set("image-digest", digest)
+	return meta
+}
+
+// defaultTags tags a service whose label declares no tags with the Compose
+// project and the image tag of its container, when known.
+func defaultTags(svc map[string]any, insp *DockerInspect) {
+	if _, ok := svc["tags"]; ok || insp == nil {
+		return
+	}
+	if _, ok := svc["Tags"]; ok {
+		return
+	}
+	var tags []any
+	if project := strings.TrimSpace(insp.Config.Labels[composeProjectLabel]); project != "" {
+		tags = append(tags, project)
+	}
+	if _, tag, _ := parseImageRef(insp.Config.Image); tag != "" {
+		tags = append(tags, tag)
+	}
+	if len(tags) > 0 {
+		svc["tags"] = tags
+	}
+}
+
+// parseImageRef splits an image reference such as "repo/app:1.2@sha256:..."
+// into its name, tag and digest. The tag defaults to "latest" when neither a
+// tag nor a digest is given, as Docker does.
+func parseImageRef(ref string) (name, tag, digest string) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "sha256:") {
+		return "", "", ""
+	}
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref, digest = ref[:i], ref[i+1:]
+	}
+	name = ref
+	// A colon after the last slash is the tag; before it, a registry port.
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		name, tag = ref[:i], ref[i+1:]
+	}
+	if tag == "" && digest == "" {
+		tag = "latest"
+	}
+	return name, tag, digest
+}
+
+// imageDigest returns the repository digest of the container's image, or ""
+// if the image has none (e.g. it was built locally). Digests are cached by
+// image ID, which cannot change for a given ID.
+func (a *Agent) imageDigest(ctx context.Context, insp *DockerInspect) string {
+	if _, _, digest := parseImageRef(insp.Config.Image); digest != "" {
+		return digest
+	}
+	if insp.Image == "" {
+		return ""
+	}
+	if d, ok := a.imageDigests[insp.Image]; ok {
+		return d
+	}
+
+	repoDigests, err := a.docker.ImageRepoDigests(ctx, insp.Image)
+	if err != nil {
+		a.metrics.Errors.WithLabelValues(errClassDocker).Inc()
+		slog.DebugContext(ctx, "image inspect failed", "image", insp.Image, "error", err)
+		return ""
+	}
+
+	// Prefer the digest of the repository the container was created from.
+	name, _, _ := parseImageRef(insp.Config.Image)
+	digest := ""
+	for _, rd := range repoDigests {
+		repo, d, ok := strings.Cut(rd, "@")
+		if !ok {
+			continue
+		}
+		if digest == "" || repo == name {
+			digest = d
+		}
+		if repo == name {
+			break
+		}
+	}
+
+	if a.imageDigests == nil || len(a.imageDigests) >= maxImageDigests {
+		a.imageDigests = map[string]string{}
+	}
+	a.imageDigests[insp.Image] = digest
+	return digest
+}
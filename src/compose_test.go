@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestParseImageRef(t *testing.T) {
+	tests := []struct {
+		ref                           string
+		wantName, wantTag, wantDigest string
+	}{
+		{ref: "nginx", wantName: "nginx", wantTag: "latest"},
+		{ref: "nginx:1.27", wantName: "nginx", wantTag: "1.27"},
+		{ref: "repo/app:1.2@sha256:abc", wantName: "repo/app", wantTag: "1.2", wantDigest: "sha256:abc"},
+		{ref: "repo/app@sha256:abc", wantName: "repo/app", wantDigest: "sha256:abc"},
+		{ref: "registry:5000/app", wantName: "registry:5000/app", wantTag: "latest"},
+		{ref: "registry:5000/team/app:v2", wantName: "registry:5000/team/app", wantTag: "v2"},
+		{ref: " nginx:1.27 ", wantName: "nginx", wantTag: "1.27"},
+		{ref: "sha256:0123"},
+		{ref: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			name, tag, digest := parseImageRef(tt.ref)
+			if name != tt.wantName || tag != tt.wantTag || digest != tt.wantDigest {
+				t.Errorf("parseImageRef(%q) = %q, %q, %q, want %q, %q, %q", tt.ref, name, tag, digest, tt.wantName, tt.wantTag, tt.wantDigest)
+			}
+		})
+	}
+}
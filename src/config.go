@@ -0,0 +1,942 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+// defaultLabelPrefix is the prefix of the consul.service.<name> and
+// consul.sidecar.<name> labels.
+const defaultLabelPrefix = "consul"
+
+// Default state locations of the default label prefix. Instances with
+// another prefix get their own, see stateDefaults.
+const (
+	defaultStatePath         = "/tmp/registrator-state.json"
+	defaultStateConsulPrefix = "consul-registrator/state"
+)
+
+type Config struct {
+	DockerSocket string
+
+	// LabelPrefix namespaces the labels read by this instance:
+	// <prefix>.service.<name> and <prefix>.sidecar.<name>. Instances with
+	// different prefixes on one host own separate services and sidecars.
+	LabelPrefix string
+
+	// Only containers matching all the filters are considered. They are
+	// passed to the Docker container list: labels as "key" or "key=value",
+	// networks by name or ID, and a regular expression on the name.
+	FilterLabels         []string
+	FilterNetworks       []string
+	FilterComposeProject string
+	FilterName           string
+
+	ConsulAddr  string
+	ConsulToken string
+	// Default Consul Enterprise namespace and admin partition of services
+	// that do not set `namespace` or `partition` in their HCL.
+	ConsulNamespace string
+	ConsulPartition string
+	ConsulTLS       ConsulTLS
+	// LegacyTags also writes the bookkeeping marks kept in the service
+	// meta as "consul-registrator.*" tags, as older versions did.
+	LegacyTags bool
+
+	// Targets are the Consul agents other than the default one, by name.
+	// Services pick one with the <prefix>.target.<name> label.
+	Targets map[string]ConsulTarget
+
+	StateBackend string
+	// StatePath and StateConsulPrefix default to locations derived from
+	// LabelPrefix, filled in by Validate.
+	StatePath         string
+	StateConsulPrefix string
+
+	MetricsAddr string
+	// ReadyIntervals is how many reconcile intervals may pass without a
+	// successful cycle before /readyz reports not ready.
+	ReadyIntervals int64
+
+	// LogFormat is "text" or "json"; LogLevel one of debug, info, warn,
+	// error. Service payloads are only logged at debug.
+	LogFormat string
+	LogLevel  string
+
+	// Spans are exported over OTLP/HTTP to TracingEndpoint, or to the
+	// endpoint set by the OTEL_EXPORTER_OTLP_* variables when empty.
+	TracingEnabled  bool
+	TracingEndpoint string
+	TracingInsecure bool
+
+	// The admin API is served on MetricsAddr under /admin/.
+	AdminEnabled bool
+	AdminToken   string
+
+	Interval           time.Duration
+	ReRegisterInterval time.Duration
+	ReRegisterJitter   time.Duration
+
+	SidecarEnabled            bool
+	SidecarImage              string
+	SidecarHttpAddr           string
+	SidecarGrpcAddr           string
+	SidecarGrpcTLS            bool
+	SidecarCAPath             string
+	SidecarPrometheusBindAddr string
+	SidecarConsulBinary       string
+
+	// SidecarProvider is the default proxy kind: envoy, consul-proxy or
+	// template. Services may pick another one with `provider` in their
+	// consul.sidecar label.
+	SidecarProvider     string
+	SidecarTemplateFile string
+
+	// SidecarRecreateConcurrency caps how many sidecars whose spec changed
+	// are recreated per cycle.
+	SidecarRecreateConcurrency int64
+
+	SidecarHardening SidecarHardening
+
+	// sidecarProviders is built by Validate.
+	sidecarProviders map[string]SidecarProvider
+}
+
+// SidecarHardening is applied to the HostConfig of every sidecar container.
+type SidecarHardening struct {
+	CapDrop         []string
+	CapAdd          []string
+	ReadonlyRootfs  bool
+	Tmpfs           []string // "path" or "path:options"
+	Memory          string   // e.g. "256m", empty for no limit
+	CPUs            string   // e.g. "0.5", empty for no limit
+	PidsLimit       int64    // 0 for no limit
+	NoNewPrivileges bool
+	SeccompProfile  string // path to a JSON profile, or "unconfined"
+	AppArmorProfile string
+	UsernsMode      string
+}
+
+func defaultSidecarHardening() SidecarHardening {
+	return SidecarHardening{
+		CapDrop:         []string{"ALL"},
+		ReadonlyRootfs:  true,
+		Tmpfs:           []string{"/tmp:rw,noexec,nosuid,size=16m"},
+		Memory:          "256m",
+		CPUs:            "1",
+		PidsLimit:       256,
+		NoNewPrivileges: true,
+	}
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		DockerSocket:               "/var/run/docker.sock",
+		LabelPrefix:                defaultLabelPrefix,
+		ConsulAddr:                 "http://localhost:8500",
+		StateBackend:               "file",
+		MetricsAddr:                ":9090",
+		ReadyIntervals:             3,
+		LogFormat:                  "text",
+		LogLevel:                   "info",
+		Interval:                   10 * time.Second,
+		ReRegisterInterval:         defaultReRegisterInterval,
+		ReRegisterJitter:           time.Minute,
+		SidecarConsulBinary:        "consul",
+		SidecarProvider:            sidecarProviderEnvoy,
+		SidecarRecreateConcurrency: 1,
+		SidecarHardening:           defaultSidecarHardening(),
+	}
+}
+
+// LoadConfig builds the configuration from the defaults, the optional HCL
+// config file at path, then environment variables. Flags are applied on top
+// by the caller.
+func LoadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadEnv applies the environment variables. Values that cannot be parsed
+// are reported together.
+func (cfg *Config) loadEnv() error {
+	var errs []error
+	envString("DOCKER_SOCKET", &cfg.DockerSocket)
+	envString("LABEL_PREFIX", &cfg.LabelPrefix)
+	envList("FILTER_LABELS", &cfg.FilterLabels)
+	envList("FILTER_NETWORKS", &cfg.FilterNetworks)
+	envString("FILTER_COMPOSE_PROJECT", &cfg.FilterComposeProject)
+	envString("FILTER_NAME", &cfg.FilterName)
+	envString("CONSUL_HTTP_ADDR", &cfg.ConsulAddr)
+	envString("CONSUL_HTTP_TOKEN", &cfg.ConsulToken)
+	envString("CONSUL_NAMESPACE", &cfg.ConsulNamespace)
+	envString("CONSUL_PARTITION", &cfg.ConsulPartition)
+	envString("CONSUL_CACERT", &cfg.ConsulTLS.CAFile)
+	envString("CONSUL_CLIENT_CERT", &cfg.ConsulTLS.CertFile)
+	envString("CONSUL_CLIENT_KEY", &cfg.ConsulTLS.KeyFile)
+	envString("CONSUL_TLS_SERVER_NAME", &cfg.ConsulTLS.ServerName)
+	if _, ok := os.LookupEnv("CONSUL_HTTP_SSL_VERIFY"); ok {
+		cfg.ConsulTLS.SkipVerify = !envBool("CONSUL_HTTP_SSL_VERIFY")
+	}
+	envFlag("LEGACY_TAGS", &cfg.LegacyTags)
+	envString("STATE_BACKEND", &cfg.StateBackend)
+	envString("STATE_PATH", &cfg.StatePath)
+	envString("STATE_CONSUL_PREFIX", &cfg.StateConsulPrefix)
+	envString("METRICS_ADDR", &cfg.MetricsAddr)
+	errs = append(errs, envInt("READY_INTERVALS", &cfg.ReadyIntervals))
+	envString("LOG_FORMAT", &cfg.LogFormat)
+	envString("LOG_LEVEL", &cfg.LogLevel)
+	envFlag("TRACING_ENABLED", &cfg.TracingEnabled)
+	envString("TRACING_ENDPOINT", &cfg.TracingEndpoint)
+	envFlag("TRACING_INSECURE", &cfg.TracingInsecure)
+	envFlag("ADMIN_ENABLED", &cfg.AdminEnabled)
+	envString("ADMIN_TOKEN", &cfg.AdminToken)
+	errs = append(errs, envDuration("RECONCILE_INTERVAL", &cfg.Interval))
+	errs = append(errs, envDuration("REREGISTER_INTERVAL", &cfg.ReRegisterInterval))
+	errs = append(errs, envDuration("REREGISTER_JITTER", &cfg.ReRegisterJitter))
+
+	envFlag("SIDECAR_ENABLED", &cfg.SidecarEnabled)
+	envString("SIDECAR_IMAGE", &cfg.SidecarImage)
+	envString("SIDECAR_CONSUL_HTTP", &cfg.SidecarHttpAddr)
+	envString("SIDECAR_CONSUL_GRPC", &cfg.SidecarGrpcAddr)
+	envFlag("SIDECAR_GRPC_TLS", &cfg.SidecarGrpcTLS)
+	envString("SIDECAR_GRPC_CA_FILE", &cfg.SidecarCAPath)
+	envString("SIDECAR_PROMETHEUS_BIND_ADDR", &cfg.SidecarPrometheusBindAddr)
+	envString("SIDECAR_CONSUL_BINARY", &cfg.SidecarConsulBinary)
+	errs = append(errs, envInt("SIDECAR_RECREATE_CONCURRENCY", &cfg.SidecarRecreateConcurrency))
+	envString("SIDECAR_PROVIDER", &cfg.SidecarProvider)
+	envString("SIDECAR_TEMPLATE_FILE", &cfg.SidecarTemplateFile)
+
+	h := &cfg.SidecarHardening
+	envList("SIDECAR_CAP_DROP", &h.CapDrop)
+	envList("SIDECAR_CAP_ADD", &h.CapAdd)
+	envFlag("SIDECAR_READONLY_ROOTFS", &h.ReadonlyRootfs)
+	envList("SIDECAR_TMPFS", &h.Tmpfs)
+	envString("SIDECAR_MEMORY", &h.Memory)
+	envString("SIDECAR_CPUS", &h.CPUs)
+	errs = append(errs, envInt("SIDECAR_PIDS_LIMIT", &h.PidsLimit))
+	envFlag("SIDECAR_NO_NEW_PRIVILEGES", &h.NoNewPrivileges)
+	envString("SIDECAR_SECCOMP_PROFILE", &h.SeccompProfile)
+	envString("SIDECAR_APPARMOR_PROFILE", &h.AppArmorProfile)
+	envString("SIDECAR_USERNS_MODE", &h.UsernsMode)
+	return errors.Join(errs...)
+}
+
+func envString(key string, dst *string) {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		*dst = v
+	}
+}
+
+func envFlag(key string, dst *bool) {
+	if _, ok := os.LookupEnv(key); ok {
+		*dst = envBool(key)
+	}
+}
+
+// envList reads a comma-separated list; "none" clears the default.
+func envList(key string, dst *[]string) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return
+	}
+	if strings.EqualFold(strings.TrimSpace(v), "none") {
+		*dst = nil
+		return
+	}
+	var out []string
+	for _, it := range strings.Split(v, ",") {
+		if it = strings.TrimSpace(it); it != "" {
+			out = append(out, it)
+		}
+	}
+	*dst = out
+}
+
+func envInt(key string, dst *int64) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s: expected an integer, got %q", key, v)
+	}
+	*dst = n
+	return nil
+}
+
+func envDuration(key string, dst *time.Duration) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(v))
+	if err != nil {
+		return fmt.Errorf("%s: expected a duration, got %q", key, v)
+	}
+	*dst = d
+	return nil
+}
+
+// normalize cleans up values that have several accepted spellings, and
+// fills in the defaults that depend on other settings.
+func (cfg *Config) normalize() {
+	prom := strings.TrimSpace(cfg.SidecarPrometheusBindAddr)
+	switch strings.ToLower(prom) {
+	case "", "0", "off", "false", "disabled":
+		prom = ""
+	}
+	cfg.SidecarPrometheusBindAddr = prom
+	path, prefix := stateDefaults(cfg.LabelPrefix)
+	if cfg.StatePath == "" {
+		cfg.StatePath = path
+	}
+	if cfg.StateConsulPrefix == "" {
+		cfg.StateConsulPrefix = prefix
+	}
+	cfg.StateBackend = strings.ToLower(strings.TrimSpace(cfg.StateBackend))
+	cfg.SidecarProvider = strings.ToLower(strings.TrimSpace(cfg.SidecarProvider))
+	cfg.LogFormat = strings.ToLower(strings.TrimSpace(cfg.LogFormat))
+	cfg.LogLevel = strings.ToLower(strings.TrimSpace(cfg.LogLevel))
+}
+
+// Validate normalizes the configuration and reports every invalid setting.
+func (cfg *Config) Validate() error {
+	cfg.normalize()
+
+	var errs []error
+	if strings.TrimSpace(cfg.DockerSocket) == "" {
+		errs = append(errs, errors.New("docker socket must be set"))
+	}
+	if strings.TrimSpace(cfg.ConsulAddr) == "" {
+		errs = append(errs, errors.New("consul address must be set"))
+	}
+	errs = append(errs, cfg.validateTargets()...)
+	if cfg.LabelPrefix == "" || strings.ContainsAny(cfg.LabelPrefix, "= \t") || strings.HasSuffix(cfg.LabelPrefix, ".") {
+		errs = append(errs, fmt.Errorf("invalid label prefix %q", cfg.LabelPrefix))
+	}
+	if cfg.FilterName != "" {
+		if _, err := regexp.Compile(cfg.FilterName); err != nil {
+			errs = append(errs, fmt.Errorf("invalid container name filter: %w", err))
+		}
+	}
+	switch cfg.StateBackend {
+	case "file":
+		if strings.TrimSpace(cfg.StatePath) == "" {
+			errs = append(errs, errors.New("state path must be set for the file backend"))
+		}
+	case "consul":
+		if strings.Trim(cfg.StateConsulPrefix, "/ ") == "" {
+			errs = append(errs, errors.New("state consul prefix must be set for the consul backend"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown state backend %q (want file or consul)", cfg.StateBackend))
+	}
+	if cfg.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("interval must be positive, got %s", cfg.Interval))
+	}
+	switch cfg.LogFormat {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("invalid log format %q (want text or json)", cfg.LogFormat))
+	}
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.AdminEnabled && cfg.AdminToken == "" && !isLoopbackAddr(cfg.MetricsAddr) {
+		errs = append(errs, fmt.Errorf("admin API without a token requires a loopback metrics address, got %q", cfg.MetricsAddr))
+	}
+	if cfg.ReadyIntervals < 1 {
+		errs = append(errs, fmt.Errorf("ready intervals must be at least 1, got %d", cfg.ReadyIntervals))
+	}
+	if cfg.ReRegisterInterval <= 0 {
+		errs = append(errs, fmt.Errorf("reregister interval must be positive, got %s", cfg.ReRegisterInterval))
+	}
+	if cfg.ReRegisterJitter < 0 {
+		errs = append(errs, fmt.Errorf("reregister jitter must not be negative, got %s", cfg.ReRegisterJitter))
+	}
+	if cfg.SidecarEnabled {
+		if cfg.SidecarImage == "" {
+			errs = append(errs, errors.New("sidecar image must be set when sidecars are enabled"))
+		}
+		if cfg.SidecarHttpAddr == "" || cfg.SidecarGrpcAddr == "" {
+			errs = append(errs, errors.New("sidecar consul http and grpc addresses must be set when sidecars are enabled"))
+		}
+	}
+	if cfg.SidecarRecreateConcurrency < 1 {
+		errs = append(errs, fmt.Errorf("sidecar recreate concurrency must be at least 1, got %d", cfg.SidecarRecreateConcurrency))
+	}
+	if cfg.SidecarPrometheusBindAddr != "" {
+		if _, port, err := parseHostPort(cfg.SidecarPrometheusBindAddr); err != nil || !isValidPort(port) {
+			errs = append(errs, fmt.Errorf("invalid sidecar prometheus bind addr %q", cfg.SidecarPrometheusBindAddr))
+		}
+	}
+	errs = append(errs, cfg.SidecarHardening.validate()...)
+	if providers, err := NewSidecarProviders(cfg); err != nil {
+		errs = append(errs, err)
+	} else if _, ok := providers[cfg.SidecarProvider]; !ok {
+		errs = append(errs, fmt.Errorf("unknown sidecar provider %q (want envoy, consul-proxy or template with a template file)", cfg.SidecarProvider))
+	} else {
+		cfg.sidecarProviders = providers
+	}
+	return errors.Join(errs...)
+}
+
+func (h *SidecarHardening) validate() []error {
+	var errs []error
+	if _, err := parseByteSize(h.Memory); err != nil {
+		errs = append(errs, fmt.Errorf("sidecar memory: %w", err))
+	}
+	if _, err := parseNanoCPUs(h.CPUs); err != nil {
+		errs = append(errs, fmt.Errorf("sidecar cpus: %w", err))
+	}
+	if h.PidsLimit < 0 {
+		errs = append(errs, fmt.Errorf("sidecar pids limit must not be negative, got %d", h.PidsLimit))
+	}
+	for _, t := range h.Tmpfs {
+		if !strings.HasPrefix(t, "/") {
+			errs = append(errs, fmt.Errorf("sidecar tmpfs %q must be an absolute path", t))
+		}
+	}
+	if p := h.SeccompProfile; p != "" && p != "unconfined" {
+		if _, err := os.Stat(p); err != nil {
+			errs = append(errs, fmt.Errorf("sidecar seccomp profile: %w", err))
+		}
+	}
+	return errs
+}
+
+// parseByteSize parses sizes such as "512", "64k", "256m" or "1g".
+func parseByteSize(in string) (int64, error) {
+	in = strings.ToLower(strings.TrimSpace(in))
+	if in == "" || in == "0" {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch in[len(in)-1] {
+	case 'k':
+		mult = 1 << 10
+	case 'm':
+		mult = 1 << 20
+	case 'g':
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		in = in[:len(in)-1]
+	}
+	n, err := strconv.ParseInt(strings.TrimSuffix(in, "b"), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", in)
+	}
+	return n * mult, nil
+}
+
+// parseNanoCPUs parses a fractional CPU count ("0.5") into Docker NanoCpus.
+func parseNanoCPUs(in string) (int64, error) {
+	in = strings.TrimSpace(in)
+	if in == "" || in == "0" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(in, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid cpu count %q", in)
+	}
+	return int64(f * 1e9), nil
+}
+
+// Log records the effective configuration. Tokens are only reported as set
+// or not.
+func (cfg *Config) Log() {
+	slog.Info("config",
+		"docker_socket", cfg.DockerSocket,
+		"label_prefix", cfg.LabelPrefix,
+		"filter_labels", cfg.FilterLabels,
+		"filter_networks", cfg.FilterNetworks,
+		"filter_compose_project", cfg.FilterComposeProject,
+		"filter_name", cfg.FilterName,
+		"consul_addr", cfg.ConsulAddr,
+		"consul_token_set", cfg.ConsulToken != "",
+		"consul_namespace", cfg.ConsulNamespace,
+		"consul_partition", cfg.ConsulPartition,
+		"consul_ca_file", cfg.ConsulTLS.CAFile,
+		"legacy_tags", cfg.LegacyTags,
+		"targets", sortedKeys(cfg.Targets),
+		"state_backend", cfg.StateBackend,
+		"state_path", cfg.StatePath,
+		"state_consul_prefix", cfg.StateConsulPrefix,
+		"metrics_addr", cfg.MetricsAddr,
+		"ready_intervals", cfg.ReadyIntervals,
+		"admin_enabled", cfg.AdminEnabled,
+		"admin_token_set", cfg.AdminToken != "",
+		"interval", cfg.Interval,
+		"reregister_interval", cfg.ReRegisterInterval,
+		"reregister_jitter", cfg.ReRegisterJitter,
+		"log_format", cfg.LogFormat,
+		"log_level", cfg.LogLevel,
+		"tracing_enabled", cfg.TracingEnabled,
+		"tracing_endpoint", cfg.TracingEndpoint,
+	)
+	slog.Info("config sidecar",
+		"enabled", cfg.SidecarEnabled,
+		"image", cfg.SidecarImage,
+		"consul_http", cfg.SidecarHttpAddr,
+		"consul_grpc", cfg.SidecarGrpcAddr,
+		"grpc_tls", cfg.SidecarGrpcTLS,
+		"grpc_ca_file", cfg.SidecarCAPath,
+		"prometheus_bind_addr", cfg.SidecarPrometheusBindAddr,
+		"consul_binary", cfg.SidecarConsulBinary,
+		"recreate_concurrency", cfg.SidecarRecreateConcurrency,
+		"provider", cfg.SidecarProvider,
+		"template_file", cfg.SidecarTemplateFile,
+	)
+	h := cfg.SidecarHardening
+	slog.Info("config sidecar hardening",
+		"cap_drop", h.CapDrop,
+		"cap_add", h.CapAdd,
+		"readonly_rootfs", h.ReadonlyRootfs,
+		"tmpfs", h.Tmpfs,
+		"memory", h.Memory,
+		"cpus", h.CPUs,
+		"pids_limit", h.PidsLimit,
+		"no_new_privileges", h.NoNewPrivileges,
+		"seccomp", h.SeccompProfile,
+		"apparmor", h.AppArmorProfile,
+		"userns", h.UsernsMode,
+	)
+}
+
+// loadFile reads an HCL config file made of one block per section:
+//
+//	docker  { socket = "/var/run/docker.sock"  label_prefix = "consul"  filter_labels = ["env=prod"] ... }
+//	consul  { address = "http://localhost:8500"  token = "..."  ca_file = "..." }
+//	target "dc2" { address = "https://consul-dc2:8501"  token = "..." }
+//	state   { backend = "file"  path = "/data/state.json"  consul_prefix = "..." }
+//	metrics { address = ":9090"  ready_intervals = 3 }
+//	admin   { enabled = true  token = "..." }
+//	log     { format = "json"  level = "info" }
+//	tracing { enabled = true  endpoint = "http://otel-collector:4318" }
+//	policy  { interval = "10s"  reregister_interval = "5m"  reregister_jitter = "1m" }
+//	sidecar { enabled = true  image = "..."  consul_http = "..."  consul_grpc = "..." ... }
+//	sidecar_hardening { cap_drop = ["ALL"]  readonly_rootfs = true  memory = "256m" ... }
+func (cfg *Config) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	parser := hclparse.NewParser()
+	f, diags := parser.ParseHCL(b, path)
+	if diags.HasErrors() {
+		return errors.New(diags.Error())
+	}
+	body, ok := f.Body.(*hclsyntax.Body)
+	if !ok {
+		return fmt.Errorf("invalid HCL body")
+	}
+	if len(body.Attributes) > 0 {
+		return fmt.Errorf("top-level attributes are not supported, use blocks")
+	}
+
+	// target blocks are labeled, which hclBodyToMap does not keep.
+	var errs []error
+	rest, targets := splitBlocks(body, "target")
+	for _, b := range targets {
+		if err := cfg.loadTarget(b); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	root, err := hclBodyToMap(rest)
+	if err != nil {
+		return err
+	}
+
+	for name, raw := range root {
+		values, _ := raw.(map[string]any)
+		s := &configSection{name: name, values: values, used: map[string]bool{}}
+
+		switch name {
+		case "docker":
+			s.str("socket", &cfg.DockerSocket)
+			s.str("label_prefix", &cfg.LabelPrefix)
+			s.list("filter_labels", &cfg.FilterLabels)
+			s.list("filter_networks", &cfg.FilterNetworks)
+			s.str("filter_compose_project", &cfg.FilterComposeProject)
+			s.str("filter_name", &cfg.FilterName)
+		case "consul":
+			s.str("address", &cfg.ConsulAddr)
+			s.str("token", &cfg.ConsulToken)
+			s.str("namespace", &cfg.ConsulNamespace)
+			s.str("partition", &cfg.ConsulPartition)
+			s.consulTLS(&cfg.ConsulTLS)
+			s.boolean("legacy_tags", &cfg.LegacyTags)
+		case "state":
+			s.str("backend", &cfg.StateBackend)
+			s.str("path", &cfg.StatePath)
+			s.str("consul_prefix", &cfg.StateConsulPrefix)
+		case "metrics":
+			s.str("address", &cfg.MetricsAddr)
+			s.integer("ready_intervals", &cfg.ReadyIntervals)
+		case "log":
+			s.str("format", &cfg.LogFormat)
+			s.str("level", &cfg.LogLevel)
+		case "tracing":
+			s.boolean("enabled", &cfg.TracingEnabled)
+			s.str("endpoint", &cfg.TracingEndpoint)
+			s.boolean("insecure", &cfg.TracingInsecure)
+		case "admin":
+			s.boolean("enabled", &cfg.AdminEnabled)
+			s.str("token", &cfg.AdminToken)
+		case "policy":
+			s.duration("interval", &cfg.Interval)
+			s.duration("reregister_interval", &cfg.ReRegisterInterval)
+			s.duration("reregister_jitter", &cfg.ReRegisterJitter)
+		case "sidecar":
+			s.boolean("enabled", &cfg.SidecarEnabled)
+			s.str("image", &cfg.SidecarImage)
+			s.str("consul_http", &cfg.SidecarHttpAddr)
+			s.str("consul_grpc", &cfg.SidecarGrpcAddr)
+			s.boolean("grpc_tls", &cfg.SidecarGrpcTLS)
+			s.str("grpc_ca_file", &cfg.SidecarCAPath)
+			s.str("prometheus_bind_addr", &cfg.SidecarPrometheusBindAddr)
+			s.str("consul_binary", &cfg.SidecarConsulBinary)
+			s.integer("recreate_concurrency", &cfg.SidecarRecreateConcurrency)
+			s.str("provider", &cfg.SidecarProvider)
+			s.str("template_file", &cfg.SidecarTemplateFile)
+		case "sidecar_hardening":
+			h := &cfg.SidecarHardening
+			s.list("cap_drop", &h.CapDrop)
+			s.list("cap_add", &h.CapAdd)
+			s.boolean("readonly_rootfs", &h.ReadonlyRootfs)
+			s.list("tmpfs", &h.Tmpfs)
+			s.str("memory", &h.Memory)
+			s.str("cpus", &h.CPUs)
+			s.integer("pids_limit", &h.PidsLimit)
+			s.boolean("no_new_privileges", &h.NoNewPrivileges)
+			s.str("seccomp_profile", &h.SeccompProfile)
+			s.str("apparmor_profile", &h.AppArmorProfile)
+			s.str("userns_mode", &h.UsernsMode)
+		default:
+			errs = append(errs, fmt.Errorf("unknown block %q", name))
+			continue
+		}
+
+		errs = append(errs, s.finish()...)
+	}
+	return errors.Join(errs...)
+}
+
+// loadTarget decodes a `target "<name>" { ... }` block.
+func (cfg *Config) loadTarget(b *hclsyntax.Block) error {
+	if len(b.Labels) != 1 || b.Labels[0] == "" {
+		return errors.New(`target blocks need a name: target "<name>" { ... }`)
+	}
+	name := b.Labels[0]
+	if name == defaultTarget {
+		return fmt.Errorf("target %q is reserved, use the consul block", name)
+	}
+	if _, dup := cfg.Targets[name]; dup {
+		return fmt.Errorf("duplicate target %q", name)
+	}
+	values, err := hclBodyToMap(b.Body)
+	if err != nil {
+		return fmt.Errorf("target %q: %w", name, err)
+	}
+
+	t := ConsulTarget{Name: name}
+	s := &configSection{name: "target " + name, values: values, used: map[string]bool{}}
+	s.str("address", &t.Address)
+	s.str("token", &t.Token)
+	s.str("namespace", &t.Namespace)
+	s.str("partition", &t.Partition)
+	s.consulTLS(&t.TLS)
+	s.str("sidecar_consul_http", &t.SidecarHttpAddr)
+	s.str("sidecar_consul_grpc", &t.SidecarGrpcAddr)
+	if err := errors.Join(s.finish()...); err != nil {
+		return err
+	}
+	if cfg.Targets == nil {
+		cfg.Targets = map[string]ConsulTarget{}
+	}
+	cfg.Targets[name] = t
+	return nil
+}
+
+// consulTLS decodes the TLS attributes shared by the consul and target
+// blocks.
+func (s *configSection) consulTLS(dst *ConsulTLS) {
+	s.str("ca_file", &dst.CAFile)
+	s.str("cert_file", &dst.CertFile)
+	s.str("key_file", &dst.KeyFile)
+	s.str("tls_server_name", &dst.ServerName)
+	s.boolean("tls_skip_verify", &dst.SkipVerify)
+}
+
+// configSection decodes the attributes of one config file block and records
+// type errors and unknown attributes.
+type configSection struct {
+	name   string
+	values map[string]any
+	used   map[string]bool
+	errs   []error
+}
+
+func (s *configSection) lookup(key string) (any, bool) {
+	v, ok := s.values[key]
+	s.used[key] = true
+	return v, ok && v != nil
+}
+
+func (s *configSection) str(key string, dst *string) {
+	v, ok := s.lookup(key)
+	if !ok {
+		return
+	}
+	x, isStr := v.(string)
+	if !isStr {
+		s.errs = append(s.errs, fmt.Errorf("%s.%s: expected a string", s.name, key))
+		return
+	}
+	*dst = x
+}
+
+func (s *configSection) boolean(key string, dst *bool) {
+	v, ok := s.lookup(key)
+	if !ok {
+		return
+	}
+	x, isBool := v.(bool)
+	if !isBool {
+		s.errs = append(s.errs, fmt.Errorf("%s.%s: expected a bool", s.name, key))
+		return
+	}
+	*dst = x
+}
+
+func (s *configSection) integer(key string, dst *int64) {
+	v, ok := s.lookup(key)
+	if !ok {
+		return
+	}
+	x, isInt := v.(int64)
+	if !isInt {
+		s.errs = append(s.errs, fmt.Errorf("%s.%s: expected a number", s.name, key))
+		return
+	}
+	*dst = x
+}
+
+func (s *configSection) list(key string, dst *[]string) {
+	v, ok := s.lookup(key)
+	if !ok {
+		return
+	}
+	items, isList := v.([]any)
+	if !isList {
+		s.errs = append(s.errs, fmt.Errorf("%s.%s: expected a list of strings", s.name, key))
+		return
+	}
+	out := make([]string, 0, len(items))
+	for _, it := range items {
+		str, isStr := it.(string)
+		if !isStr {
+			s.errs = append(s.errs, fmt.Errorf("%s.%s: expected a list of strings", s.name, key))
+			return
+		}
+		out = append(out, str)
+	}
+	*dst = out
+}
+
+func (s *configSection) intList(key string, dst *[]int64) {
+	v, ok := s.lookup(key)
+	if !ok {
+		return
+	}
+	items, isList := v.([]any)
+	if !isList {
+		s.errs = append(s.errs, fmt.Errorf("%s.%s: expected a list of numbers", s.name, key))
+		return
+	}
+	out := make([]int64, 0, len(items))
+	for _, it := range items {
+		n, isInt := it.(int64)
+		if !isInt {
+			s.errs = append(s.errs, fmt.Errorf("%s.%s: expected a list of numbers", s.name, key))
+			return
+		}
+		out = append(out, n)
+	}
+	*dst = out
+}
+
+func (s *configSection) stringMap(key string, dst *map[string]string) {
+	v, ok := s.lookup(key)
+	if !ok {
+		return
+	}
+	m, isMap := v.(map[string]any)
+	if !isMap {
+		s.errs = append(s.errs, fmt.Errorf("%s.%s: expected a map of strings", s.name, key))
+		return
+	}
+	out := make(map[string]string, len(m))
+	for k, it := range m {
+		str, isStr := it.(string)
+		if !isStr {
+			s.errs = append(s.errs, fmt.Errorf("%s.%s.%s: expected a string", s.name, key, k))
+			continue
+		}
+		out[k] = str
+	}
+	*dst = out
+}
+
+// duration accepts a Go duration string ("30s") or a number of seconds.
+func (s *configSection) duration(key string, dst *time.Duration) {
+	v, ok := s.lookup(key)
+	if !ok {
+		return
+	}
+	switch x := v.(type) {
+	case string:
+		d, err := time.ParseDuration(x)
+		if err != nil {
+			s.errs = append(s.errs, fmt.Errorf("%s.%s: %w", s.name, key, err))
+			return
+		}
+		*dst = d
+	case int64:
+		*dst = time.Duration(x) * time.Second
+	default:
+		s.errs = append(s.errs, fmt.Errorf("%s.%s: expected a duration", s.name, key))
+	}
+}
+
+func (s *configSection) finish() []error {
+	var unknown []string
+	for k := range s.values {
+		if !s.used[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	for _, k := range unknown {
+		s.errs = append(s.errs, fmt.Errorf("%s.%s: unknown attribute", s.name, k))
+	}
+	return s.errs
+}
+
+// stateDefaults returns the default state file and KV prefix of an instance
+// with the given label prefix, so instances sharing a host or a Consul
+// cluster do not share their state unless told to.
+func stateDefaults(labelPrefix string) (path, kvPrefix string) {
+	if labelPrefix == defaultLabelPrefix {
+		return defaultStatePath, defaultStateConsulPrefix
+	}
+	name := fileSafe(labelPrefix)
+	return "/tmp/registrator-state-" + name + ".json", defaultStateConsulPrefix + "-" + name
+}
+
+// fileSafe replaces the characters of s other than letters, digits, "-",
+// "_" and "." with "_", for use in file names and KV keys.
+func fileSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// isLoopbackAddr reports whether a listen address only accepts local
+// connections. An empty host listens on every interface.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	return isLoopbackHost(host)
+}
+
+// readyWindow is how long /readyz tolerates no successful reconcile.
+func (cfg *Config) readyWindow() time.Duration {
+	return cfg.Interval * time.Duration(cfg.ReadyIntervals)
+}
+
+// serviceLabelPrefix is the prefix of the labels declaring services.
+func (cfg *Config) serviceLabelPrefix() string {
+	return cfg.LabelPrefix + ".service."
+}
+
+// targetLabel is the label naming the Consul target of service name.
+func (cfg *Config) targetLabel(name string) string {
+	return cfg.LabelPrefix + ".target." + name
+}
+
+// sidecarLabel is the label requesting a sidecar for service name.
+func (cfg *Config) sidecarLabel(name string) string {
+	return cfg.LabelPrefix + ".sidecar." + name
+}
+
+// upstreamsLabel is the label declaring the upstreams of service name.
+func (cfg *Config) upstreamsLabel(name string) string {
+	return cfg.LabelPrefix + ".upstreams." + name
+}
+
+// containerFilters returns the filters of the Docker container list
+// selecting the containers to register.
+func (cfg *Config) containerFilters() map[string][]string {
+	filters := map[string][]string{}
+	labels := append([]string(nil), cfg.FilterLabels...)
+	if cfg.FilterComposeProject != "" {
+		labels = append(labels, "com.docker.compose.project="+cfg.FilterComposeProject)
+	}
+	if len(labels) > 0 {
+		filters["label"] = labels
+	}
+	if len(cfg.FilterNetworks) > 0 {
+		filters["network"] = cfg.FilterNetworks
+	}
+	if cfg.FilterName != "" {
+		filters["name"] = []string{cfg.FilterName}
+	}
+	return filters
+}
+
+// ownsSidecar reports whether a sidecar container with labels was launched
+// by an instance with this label prefix. Sidecars without an instance label
+// belong to the default prefix.
+func (cfg *Config) ownsSidecar(labels map[string]string) bool {
+	instance := labels[sidecarInstanceLabel]
+	if instance == "" {
+		instance = defaultLabelPrefix
+	}
+	return instance == cfg.LabelPrefix
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+// configEntryKinds are the config entry kinds a service label may declare.
+// All of them are named after the service.
+var configEntryKinds = map[string]bool{
+	"service-defaults":   true,
+	"service-router":     true,
+	"service-resolver":   true,
+	"service-intentions": true,
+}
+
+// ConfigEntry is a `config_entry "<kind>" { ... }` block of a service label.
+type ConfigEntry struct {
+	Kind string
+	Body map[string]any
+}
+
+// ConfigEntryState is a config entry written by the registrator.
+type ConfigEntryState struct {
+	Kind      string      `json:"kind"`
+	Name      string      `json:"name"`
+	Scope     ConsulScope `json:"scope"`
+	Hash      string      `json:"hash"`
+	AppliedAt time.Time   `json:"applied_at"`
+}
+
+// desiredConfigEntry is a config entry declared by the containers of a
+// cycle, with the services that declare it.
+type desiredConfigEntry struct {
+	ConfigEntryState
+	payload  map[string]any
+	services []*ManagedService
+}
+
+func configEntryKey(scope ConsulScope, kind, name string) string {
+	return strings.Join([]string{scope.targetName(), scope.Namespace, scope.Partition, kind, name}, "/")
+}
+
+func parseConfigEntries(blocks []*hclsyntax.Block) ([]ConfigEntry, error) {
+	var out []ConfigEntry
+	seen := map[string]bool{}
+	for _, b := range blocks {
+		if len(b.Labels) != 1 || !configEntryKinds[b.Labels[0]] {
+			return nil, fmt.Errorf(`config_entry blocks need a kind: config_entry "<%s>" { ... }`, strings.Join(sortedKeys(configEntryKinds), "|"))
+		}
+		kind := b.Labels[0]
+		if seen[kind] {
+			return nil, fmt.Errorf("multiple config_entry %q blocks", kind)
+		}
+		seen[kind] = true
+
+		body, err := hclBodyToMap(b.Body)
+		if err != nil {
+			return nil, fmt.Errorf("config_entry %q: %w", kind, err)
+		}
+		out = append(out, ConfigEntry{Kind: kind, Body: body})
+	}
+	return out, nil
+}
+
+// configEntryPayload returns the body written to /v1/config for an entry of
+// the service, marked as managed.
+func configEntryPayload(e ConfigEntry, svcName string) (map[string]any, error) {
+	payload := map[string]any{}
+	for k, v := range e.Body {
+		switch strings.ToLower(k) {
+		case "kind":
+			continue
+		case "name":
+			if v != svcName {
+				return nil, fmt.Errorf("config_entry %q: name %v does not match service %q", e.Kind, v, svcName)
+			}
+			continue
+		case "namespace", "partition":
+			return nil, fmt.Errorf("config_entry %q: %s is taken from the service", e.Kind, k)
+		}
+		payload[k] = v
+	}
+	payload["Kind"] = e.Kind
+	payload["Name"] = svcName
+	mergeMeta(payload, map[string]string{managedMetaKey: "true"}, true)
+	return payload, nil
+}
+
+// desireConfigEntries adds the config entries of a service to desired.
+// Replicas declaring different bodies for the same entry keep the first.
+func desireConfigEntries(ctx context.Context, desired map[string]*desiredConfigEntry, entries []ConfigEntry, svcName string, scope ConsulScope, entry *ManagedService) error {
+	for _, e := range entries {
+		payload, err := configEntryPayload(e, svcName)
+		if err != nil {
+			return err
+		}
+		key := configEntryKey(scope, e.Kind, svcName)
+		hash := hashServicePayload(payload)
+		if d, ok := desired[key]; ok {
+			if d.Hash != hash {
+				slog.WarnContext(ctx, "conflicting config entry, keeping the first one", "kind", e.Kind, "service", svcName, "service_id", entry.ID)
+			}
+			d.services = append(d.services, entry)
+			continue
+		}
+		desired[key] = &desiredConfigEntry{
+			ConfigEntryState: ConfigEntryState{Kind: e.Kind, Name: svcName, Scope: scope, Hash: hash},
+			payload:          payload,
+			services:         []*ManagedService{entry},
+		}
+	}
+	return nil
+}
+
+// syncConfigEntries writes the desired config entries that changed or were
+// last written a re-register interval ago, and deletes the entries written
+// earlier that no container declares anymore. Entries are cluster-wide:
+// rewriting them restores those deleted by hand or by the registrator of
+// another node. An existing entry is only overwritten if a registrator
+// wrote it. An entry no container declares is only deleted once the catalog
+// holds no other instance of its service (deregistered lists the services
+// removed this cycle, which the catalog may still show): while instances
+// remain, e.g. on other nodes, the entry is left to them and forgotten.
+func (a *Agent) syncConfigEntries(ctx context.Context, desired map[string]*desiredConfigEntry, deregistered map[string]bool) {
+	interval := a.cfg.ReRegisterInterval
+	if interval <= 0 {
+		interval = defaultReRegisterInterval
+	}
+
+	// Sorted by kind, service-defaults (which sets the protocol routers
+	// need) is written first and deleted last.
+	for _, key := range sortedKeys(desired) {
+		d := desired[key]
+		entries := a.stateOf(d.Scope.targetName()).ConfigEntries
+		prev, owned := entries[key]
+		if owned && prev.Hash == d.Hash && time.Since(prev.AppliedAt) < interval {
+			continue
+		}
+		err := a.applyConfigEntry(ctx, d, owned)
+		if err != nil {
+			a.metrics.Errors.WithLabelValues(errClassConsul).Inc()
+			a.metrics.ConfigEntries.WithLabelValues(d.Kind, "apply", "error").Inc()
+			slog.ErrorContext(ctx, "failed to apply config entry", "kind", d.Kind, "service", d.Name, "target", d.Scope.targetName(), "error", err)
+			for _, entry := range d.services {
+				entry.setError(err)
+			}
+			continue
+		}
+		a.metrics.ConfigEntries.WithLabelValues(d.Kind, "apply", "success").Inc()
+		st := d.ConfigEntryState
+		st.AppliedAt = time.Now()
+		entries[key] = st
+		if !owned || prev.Hash != d.Hash {
+			slog.InfoContext(ctx, "applied config entry", "kind", d.Kind, "service", d.Name, "target", d.Scope.targetName())
+		}
+	}
+
+	// owners maps the recorded entries to the state of their target.
+	owners := map[string]*State{}
+	for _, state := range a.states {
+		for key := range state.ConfigEntries {
+			owners[key] = state
+		}
+	}
+	stale := sortedKeys(owners)
+	sort.Sort(sort.Reverse(sort.StringSlice(stale)))
+	for _, key := range stale {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		entries := owners[key].ConfigEntries
+		st := entries[key]
+		consul, err := a.client(st.Scope)
+		var ids []string
+		if err == nil {
+			ids, err = consul.CatalogServiceInstances(ctx, st.Name, st.Scope.Namespace, st.Scope.Partition)
+		}
+		if err == nil {
+			if remaining := otherInstances(ids, deregistered); remaining > 0 {
+				delete(entries, key)
+				slog.InfoContext(ctx, "config entry still used by other instances, no longer managing it", "kind", st.Kind, "service", st.Name, "target", st.Scope.targetName(), "instances", remaining)
+				continue
+			}
+			err = consul.DeleteConfigEntry(ctx, st.Kind, st.Name, st.Scope.Namespace, st.Scope.Partition)
+		}
+		if err != nil {
+			a.metrics.Errors.WithLabelValues(errClassConsul).Inc()
+			a.metrics.ConfigEntries.WithLabelValues(st.Kind, "delete", "error").Inc()
+			slog.ErrorContext(ctx, "failed to delete config entry", "kind", st.Kind, "service", st.Name, "target", st.Scope.targetName(), "error", err)
+			continue
+		}
+		a.metrics.ConfigEntries.WithLabelValues(st.Kind, "delete", "success").Inc()
+		delete(entries, key)
+		slog.InfoContext(ctx, "deleted config entry", "kind", st.Kind, "service", st.Name, "target", st.Scope.targetName())
+	}
+}
+
+// otherInstances counts the instance IDs not in deregistered.
+func otherInstances(ids []string, deregistered map[string]bool) int {
+	n := 0
+	for _, id := range ids {
+		if !deregistered[id] {
+			n++
+		}
+	}
+	return n
+}
+
+// applyConfigEntry writes d. Unless owned, an entry that already exists
+// must carry the managed meta: entries created by hand are left alone.
+func (a *Agent) applyConfigEntry(ctx context.Context, d *desiredConfigEntry, owned bool) error {
+	consul, err := a.client(d.Scope)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		meta, exists, err := consul.ConfigEntryMeta(ctx, d.Kind, d.Name, d.Scope.Namespace, d.Scope.Partition)
+		if err != nil {
+			return err
+		}
+		if exists && meta[managedMetaKey] != "true" {
+			return fmt.Errorf("config entry %s/%s exists and is not managed by consul-registrator", d.Kind, d.Name)
+		}
+	}
+	return consul.SetConfigEntry(ctx, d.payload, d.Scope.Namespace, d.Scope.Partition)
+}
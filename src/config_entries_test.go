@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseConfigEntries(t *testing.T) {
+	tests := []struct {
+		name      string
+		label     string
+		wantKinds []string
+		wantErr   string
+	}{
+		{
+			name: "kinds",
+			label: `
+service {
+  name = "web"
+  config_entry "service-defaults" {
+    protocol = "http"
+  }
+  config_entry "service-intentions" {
+    sources = [{ name = "api", action = "allow" }]
+  }
+}`,
+			wantKinds: []string{"service-defaults", "service-intentions"},
+		},
+		{
+			name:    "no kind",
+			label:   "service {\n  config_entry {}\n}",
+			wantErr: "config_entry blocks need a kind",
+		},
+		{
+			name:    "unknown kind",
+			label:   "service {\n  config_entry \"mesh\" {}\n}",
+			wantErr: "config_entry blocks need a kind",
+		},
+		{
+			name:    "duplicate kind",
+			label:   "service {\n  config_entry \"service-defaults\" {}\n  config_entry \"service-defaults\" {}\n}",
+			wantErr: `multiple config_entry "service-defaults" blocks`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := ParseServiceHCL(tt.label)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kinds []string
+			for _, e := range parsed.ConfigEntries {
+				kinds = append(kinds, e.Kind)
+			}
+			if strings.Join(kinds, ",") != strings.Join(tt.wantKinds, ",") {
+				t.Errorf("kinds = %v, want %v", kinds, tt.wantKinds)
+			}
+		})
+	}
+}
+
+func TestConfigEntryPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    map[string]any
+		wantErr string
+	}{
+		{name: "body", body: map[string]any{"protocol": "http"}},
+		{name: "matching name", body: map[string]any{"Name": "web"}},
+		{name: "other name", body: map[string]any{"name": "api"}, wantErr: "does not match service"},
+		{name: "namespace", body: map[string]any{"namespace": "team"}, wantErr: "namespace is taken from the service"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := configEntryPayload(ConfigEntry{Kind: "service-defaults", Body: tt.body}, "web")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta, _ := payload["meta"].(map[string]any)
+			if payload["Kind"] != "service-defaults" || payload["Name"] != "web" || meta[managedMetaKey] != "true" {
+				t.Errorf("payload = %v", payload)
+			}
+		})
+	}
+}
+
+// fakeCatalog serves the instances of web and records config entry
+// deletions.
+type fakeCatalog struct {
+	mu        sync.Mutex
+	instances []string
+	deleted   []string
+}
+
+func (f *fakeCatalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/catalog/service/web":
+		out := []map[string]string{}
+		for _, id := range f.instances {
+			out = append(out, map[string]string{"ServiceID": id})
+		}
+		_ = json.NewEncoder(w).Encode(out)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v1/config/"):
+		f.mu.Lock()
+		f.deleted = append(f.deleted, strings.TrimPrefix(r.URL.Path, "/v1/config/"))
+		f.mu.Unlock()
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestSyncConfigEntriesStale(t *testing.T) {
+	tests := []struct {
+		name         string
+		instances    []string
+		deregistered map[string]bool
+		wantDeleted  bool
+	}{
+		{name: "no instances", wantDeleted: true},
+		{name: "only deregistered instances", instances: []string{"web:1"}, deregistered: map[string]bool{"web:1": true}, wantDeleted: true},
+		{name: "other instances", instances: []string{"web:1", "web:2"}, deregistered: map[string]bool{"web:1": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			catalog := &fakeCatalog{instances: tt.instances}
+			srv := httptest.NewServer(catalog)
+			defer srv.Close()
+
+			a := &Agent{
+				targets: map[string]*ConsulClient{defaultTarget: NewConsulClient(srv.URL, "", 5*time.Second, false)},
+				metrics: testMetrics(),
+				states:  map[string]*State{},
+				cfg:     defaultConfig(),
+			}
+			key := configEntryKey(ConsulScope{}, "service-defaults", "web")
+			a.stateOf(defaultTarget).ConfigEntries[key] = ConfigEntryState{Kind: "service-defaults", Name: "web"}
+
+			a.syncConfigEntries(context.Background(), map[string]*desiredConfigEntry{}, tt.deregistered)
+
+			if got := len(catalog.deleted) == 1; got != tt.wantDeleted {
+				t.Errorf("deleted = %v, want deleted %v", catalog.deleted, tt.wantDeleted)
+			}
+			if _, owned := a.stateOf(defaultTarget).ConfigEntries[key]; owned {
+				t.Error("config entry still in the state")
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadTestConfig(t *testing.T, hcl string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.hcl")
+	if err := os.WriteFile(path, []byte(hcl), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+func TestConfigFileValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		hcl     string
+		env     map[string]string
+		wantErr string
+		check   func(*testing.T, *Config)
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Interval != 10*time.Second || cfg.StateBackend != "file" {
+					t.Errorf("interval=%s backend=%q, want the defaults", cfg.Interval, cfg.StateBackend)
+				}
+				if cfg.StatePath != defaultStatePath || cfg.StateConsulPrefix != defaultStateConsulPrefix {
+					t.Errorf("state path=%q prefix=%q, want the defaults", cfg.StatePath, cfg.StateConsulPrefix)
+				}
+			},
+		},
+		{
+			name: "values",
+			hcl: `
+policy {
+  interval            = "30s"
+  reregister_interval = 600
+}
+state {
+  backend = "Consul"
+}
+sidecar_hardening {
+  cap_drop = []
+}`,
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Interval != 30*time.Second || cfg.ReRegisterInterval != 10*time.Minute {
+					t.Errorf("interval=%s reregister=%s", cfg.Interval, cfg.ReRegisterInterval)
+				}
+				if cfg.StateBackend != "consul" {
+					t.Errorf("state backend %q was not normalized", cfg.StateBackend)
+				}
+				if len(cfg.SidecarHardening.CapDrop) != 0 {
+					t.Errorf("cap_drop = %v, want it cleared", cfg.SidecarHardening.CapDrop)
+				}
+			},
+		},
+		{
+			name: "label prefix state defaults",
+			hcl:  `docker { label_prefix = "dc2" }`,
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.StatePath != "/tmp/registrator-state-dc2.json" || cfg.StateConsulPrefix != "consul-registrator/state-dc2" {
+					t.Errorf("state path=%q prefix=%q, want them derived from the prefix", cfg.StatePath, cfg.StateConsulPrefix)
+				}
+			},
+		},
+		{
+			name: "label prefix explicit state",
+			hcl: `
+docker {
+  label_prefix = "team/a"
+}
+state {
+  path = "/data/a.json"
+}`,
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.StatePath != "/data/a.json" || cfg.StateConsulPrefix != "consul-registrator/state-team_a" {
+					t.Errorf("state path=%q prefix=%q", cfg.StatePath, cfg.StateConsulPrefix)
+				}
+			},
+		},
+		{
+			name:    "top-level attribute",
+			hcl:     `interval = "10s"`,
+			wantErr: "top-level attributes are not supported",
+		},
+		{
+			name:    "unknown block",
+			hcl:     `nope {}`,
+			wantErr: `unknown block "nope"`,
+		},
+		{
+			name:    "unknown attribute",
+			hcl:     `policy { intreval = "10s" }`,
+			wantErr: "policy.intreval: unknown attribute",
+		},
+		{
+			name:    "wrong type",
+			hcl:     `sidecar { enabled = "yes" }`,
+			wantErr: "sidecar.enabled: expected a bool",
+		},
+		{
+			name:    "zero interval",
+			hcl:     `policy { interval = "0s" }`,
+			wantErr: "interval must be positive",
+		},
+		{
+			name:    "negative jitter",
+			hcl:     `policy { reregister_jitter = "-1s" }`,
+			wantErr: "reregister jitter must not be negative",
+		},
+		{
+			name:    "state backend",
+			hcl:     `state { backend = "etcd" }`,
+			wantErr: `unknown state backend "etcd"`,
+		},
+		{
+			name:    "sidecar without image",
+			hcl:     `sidecar { enabled = true }`,
+			wantErr: "sidecar image must be set",
+		},
+		{
+			name:    "admin without token",
+			hcl:     `admin { enabled = true }`,
+			wantErr: "admin API without a token requires a loopback metrics address",
+		},
+		{
+			name: "admin without token on loopback",
+			hcl: `
+metrics {
+  address = "127.0.0.1:9090"
+}
+admin {
+  enabled = true
+}`,
+		},
+		{
+			name: "admin with token",
+			hcl: `
+admin {
+  enabled = true
+  token   = "s3cr3t"
+}`,
+		},
+		{
+			name:    "malformed env duration",
+			env:     map[string]string{"RECONCILE_INTERVAL": "10 seconds"},
+			wantErr: `RECONCILE_INTERVAL: expected a duration, got "10 seconds"`,
+		},
+		{
+			name:    "malformed env integers",
+			env:     map[string]string{"READY_INTERVALS": "three", "SIDECAR_PIDS_LIMIT": "1e3"},
+			wantErr: `READY_INTERVALS: expected an integer, got "three"`,
+		},
+		{
+			name: "env values",
+			env:  map[string]string{"RECONCILE_INTERVAL": "20s", "READY_INTERVALS": "5"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Interval != 20*time.Second || cfg.ReadyIntervals != 5 {
+					t.Errorf("interval=%s ready intervals=%d", cfg.Interval, cfg.ReadyIntervals)
+				}
+			},
+		},
+		{
+			name:    "hardening memory",
+			hcl:     `sidecar_hardening { memory = "lots" }`,
+			wantErr: "sidecar memory",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := loadTestConfig(t, tt.hcl)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.check != nil {
+				tt.check(t, cfg)
+			}
+		})
+	}
+}
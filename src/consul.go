@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ConsulClient struct {
@@ -17,6 +22,8 @@ type ConsulClient struct {
 	token  string
 	client *http.Client
 	dryRun bool
+	// observe, if set, records the latency of each request.
+	observe func(method, path string, d time.Duration)
 }
 
 func NewConsulClient(addr, token string, timeout time.Duration, dryRun bool) *ConsulClient {
@@ -30,12 +37,52 @@ func NewConsulClient(addr, token string, timeout time.Duration, dryRun bool) *Co
 	}
 }
 
-func (c *ConsulClient) RegisterService(ctx context.Context, def map[string]any) error {
+// Instrument records the latency of the client's requests in m, labeled
+// with target.
+func (c *ConsulClient) Instrument(m *Metrics, target string) {
+	c.observe = func(method, path string, d time.Duration) {
+		m.ObserveConsul(target, method, path, d)
+	}
+}
+
+// ConsulScope is where a service is registered: the Consul target, and the
+// Consul Enterprise namespace and admin partition. Empty values mean the
+// default target and the agent's defaults, the only scope of Consul CE.
+type ConsulScope struct {
+	Target    string `json:"target,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Partition string `json:"partition,omitempty"`
+}
+
+// targetName is the name of the scope's target, for logs and metrics.
+func (s ConsulScope) targetName() string {
+	if s.Target == "" {
+		return defaultTarget
+	}
+	return s.Target
+}
+
+// scopeQuery returns q, allocated if nil, with the ns and partition
+// parameters of a scoped request.
+func scopeQuery(q url.Values, ns, partition string) url.Values {
+	if q == nil {
+		q = url.Values{}
+	}
+	if ns != "" {
+		q.Set("ns", ns)
+	}
+	if partition != "" {
+		q.Set("partition", partition)
+	}
+	return q
+}
+
+func (c *ConsulClient) RegisterService(ctx context.Context, def map[string]any, ns, partition string) error {
 	if c.dryRun {
 		return nil
 	}
 
-	q := url.Values{}
+	q := scopeQuery(nil, ns, partition)
 	q.Set("replace-existing-checks", "true")
 
 	return c.do(ctx, "PUT", "/v1/agent/service/register", q, def)
@@ -46,26 +93,17 @@ func (c *ConsulClient) DeregisterService(ctx context.Context, id, ns, partition
 		return nil
 	}
 
-	q := url.Values{}
-	if ns != "" {
-		q.Set("ns", ns)
-	}
-	if partition != "" {
-		q.Set("partition", partition)
-	}
+	q := scopeQuery(nil, ns, partition)
 
 	return c.do(ctx, "PUT", "/v1/agent/service/deregister/"+url.PathEscape(id), q, nil)
 }
 
-func (c *ConsulClient) PassCheck(ctx context.Context, checkID, ns, note string) error {
+func (c *ConsulClient) PassCheck(ctx context.Context, checkID, ns, partition, note string) error {
 	if c.dryRun {
 		return nil
 	}
 
-	q := url.Values{}
-	if ns != "" {
-		q.Set("ns", ns)
-	}
+	q := scopeQuery(nil, ns, partition)
 	if note != "" {
 		q.Set("note", note)
 	}
@@ -73,6 +111,31 @@ func (c *ConsulClient) PassCheck(ctx context.Context, checkID, ns, note string)
 	return c.do(ctx, "PUT", "/v1/agent/check/pass/"+url.PathEscape(checkID), q, nil)
 }
 
+// RegisterCheck registers a standalone agent check, e.g. one attached to a
+// service with ServiceID.
+func (c *ConsulClient) RegisterCheck(ctx context.Context, def map[string]any, ns, partition string) error {
+	if c.dryRun {
+		return nil
+	}
+	return c.do(ctx, "PUT", "/v1/agent/check/register", scopeQuery(nil, ns, partition), def)
+}
+
+// UpdateCheck sets the status and output of a TTL check.
+func (c *ConsulClient) UpdateCheck(ctx context.Context, checkID, ns, partition, status, output string) error {
+	if c.dryRun {
+		return nil
+	}
+	body := map[string]string{"Status": status, "Output": output}
+	return c.do(ctx, "PUT", "/v1/agent/check/update/"+url.PathEscape(checkID), scopeQuery(nil, ns, partition), body)
+}
+
+func (c *ConsulClient) DeregisterCheck(ctx context.Context, checkID, ns, partition string) error {
+	if c.dryRun {
+		return nil
+	}
+	return c.do(ctx, "PUT", "/v1/agent/check/deregister/"+url.PathEscape(checkID), scopeQuery(nil, ns, partition), nil)
+}
+
 func (c *ConsulClient) do(ctx context.Context, method, path string, q url.Values, body any) error {
 	var r *bytes.Reader
 	if body != nil {
@@ -102,7 +165,7 @@ func (c *ConsulClient) do(ctx context.Context, method, path string, q url.Values
 		req.Header.Set("X-Consul-Token", c.token)
 	}
 
-	resp, err := c.client.Do(req)
+	resp, err := c.send(req, path)
 	if err != nil {
 		return err
 	}
@@ -110,50 +173,242 @@ func (c *ConsulClient) do(ctx context.Context, method, path string, q url.Values
 
 	if resp.StatusCode >= 400 {
 		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("consul %s %s failed: %s: %s", method, u, resp.Status, strings.TrimSpace(string(b)))
+		return &consulError{method: method, url: u, status: resp.Status, code: resp.StatusCode, body: strings.TrimSpace(string(b))}
 	}
 
 	return nil
 }
 
+// consulError is the error of a request that Consul answered with an error
+// status.
+type consulError struct {
+	method, url, status string
+	code                int
+	body                string
+}
+
+func (e *consulError) Error() string {
+	return fmt.Sprintf("consul %s %s failed: %s: %s", e.method, e.url, e.status, e.body)
+}
+
+// isNotFound reports whether err is a 404 answer from Consul, e.g. to the
+// deregistration of a service the agent does not know.
+func isNotFound(err error) bool {
+	var ce *consulError
+	return errors.As(err, &ce) && ce.code == http.StatusNotFound
+}
+
 type AgentServiceInfo struct {
 	ID        string            `json:"ID"`
 	Service   string            `json:"Service"`
+	Tags      []string          `json:"Tags"`
+	Address   string            `json:"Address"`
+	Port      int               `json:"Port"`
 	Namespace string            `json:"Namespace"`
 	Partition string            `json:"Partition"`
 	Meta      map[string]string `json:"Meta"`
 }
 
-func (c *ConsulClient) AgentServices(ctx context.Context) (map[string]AgentServiceInfo, error) {
+// AgentServices lists the local agent's services in a namespace and
+// partition.
+func (c *ConsulClient) AgentServices(ctx context.Context, ns, partition string) (map[string]AgentServiceInfo, error) {
 	if c.dryRun {
 		return map[string]AgentServiceInfo{}, nil
 	}
 
-	u := c.base + "/v1/agent/services"
-	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	var out map[string]AgentServiceInfo
+	if _, err := c.get(ctx, "/v1/agent/services", scopeQuery(nil, ns, partition), &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AgentService returns the local agent's definition of a single service.
+// ok is false when the agent does not know the service.
+func (c *ConsulClient) AgentService(ctx context.Context, id, ns, partition string) (svc *AgentServiceInfo, ok bool, err error) {
+	if c.dryRun {
+		return nil, false, nil
+	}
+
+	var out AgentServiceInfo
+	status, err := c.get(ctx, "/v1/agent/service/"+url.PathEscape(id), scopeQuery(nil, ns, partition), &out)
+	if status == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &out, true, nil
+}
+
+// ConfigEntryMeta returns the meta of a config entry. ok is false when the
+// entry does not exist.
+func (c *ConsulClient) ConfigEntryMeta(ctx context.Context, kind, name, ns, partition string) (meta map[string]string, ok bool, err error) {
+	if c.dryRun {
+		return nil, false, nil
+	}
+
+	var out struct {
+		Meta map[string]string `json:"Meta"`
+	}
+	status, err := c.get(ctx, "/v1/config/"+url.PathEscape(kind)+"/"+url.PathEscape(name), scopeQuery(nil, ns, partition), &out)
+	if status == http.StatusNotFound {
+		return nil, false, nil
+	}
 	if err != nil {
+		return nil, false, err
+	}
+	return out.Meta, true, nil
+}
+
+// SetConfigEntry creates or replaces a config entry; entry holds its Kind
+// and Name.
+func (c *ConsulClient) SetConfigEntry(ctx context.Context, entry map[string]any, ns, partition string) error {
+	if c.dryRun {
+		return nil
+	}
+	return c.do(ctx, "PUT", "/v1/config", scopeQuery(nil, ns, partition), entry)
+}
+
+// CatalogServiceInstances returns the IDs of the instances of a service
+// registered in the catalog, on any node.
+func (c *ConsulClient) CatalogServiceInstances(ctx context.Context, name, ns, partition string) ([]string, error) {
+	if c.dryRun {
+		return nil, nil
+	}
+
+	var out []struct {
+		ServiceID string `json:"ServiceID"`
+	}
+	if _, err := c.get(ctx, "/v1/catalog/service/"+url.PathEscape(name), scopeQuery(nil, ns, partition), &out); err != nil {
 		return nil, err
 	}
+	ids := make([]string, 0, len(out))
+	for _, s := range out {
+		ids = append(ids, s.ServiceID)
+	}
+	return ids, nil
+}
+
+func (c *ConsulClient) DeleteConfigEntry(ctx context.Context, kind, name, ns, partition string) error {
+	if c.dryRun {
+		return nil
+	}
+	return c.do(ctx, "DELETE", "/v1/config/"+url.PathEscape(kind)+"/"+url.PathEscape(name), scopeQuery(nil, ns, partition), nil)
+}
+
+// NodeName returns the name of the node the agent runs on.
+func (c *ConsulClient) NodeName(ctx context.Context) (string, error) {
+	var self struct {
+		Config struct {
+			NodeName string `json:"NodeName"`
+		} `json:"Config"`
+	}
+	if _, err := c.get(ctx, "/v1/agent/self", nil, &self); err != nil {
+		return "", err
+	}
+	if self.Config.NodeName == "" {
+		return "", fmt.Errorf("consul agent did not report a node name")
+	}
+	return self.Config.NodeName, nil
+}
+
+// KVGet returns the raw value stored at key and its ModifyIndex.
+// found is false when the key does not exist.
+func (c *ConsulClient) KVGet(ctx context.Context, key string) (value []byte, index uint64, found bool, err error) {
+	var entries []struct {
+		ModifyIndex uint64 `json:"ModifyIndex"`
+		Value       []byte `json:"Value"`
+	}
+	status, err := c.get(ctx, "/v1/kv/"+strings.TrimLeft(key, "/"), nil, &entries)
+	if status == http.StatusNotFound {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if len(entries) == 0 {
+		return nil, 0, false, nil
+	}
+	return entries[0].Value, entries[0].ModifyIndex, true, nil
+}
+
+// KVPut writes value at key using check-and-set: the write only succeeds if
+// the key's ModifyIndex still equals cas (0 means the key must not exist).
+// ok is false when the index did not match.
+func (c *ConsulClient) KVPut(ctx context.Context, key string, value []byte, cas uint64) (ok bool, err error) {
+	if c.dryRun {
+		return true, nil
+	}
+
+	q := url.Values{}
+	q.Set("cas", strconv.FormatUint(cas, 10))
+	u := c.base + "/v1/kv/" + strings.TrimLeft(key, "/") + "?" + q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", u, bytes.NewReader(value))
+	if err != nil {
+		return false, err
+	}
 	if c.token != "" {
 		req.Header.Set("X-Consul-Token", c.token)
 	}
 
-	resp, err := c.client.Do(req)
+	resp, err := c.send(req, "/v1/kv/")
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 	defer resp.Body.Close()
 
+	b, _ := io.ReadAll(resp.Body)
 	if resp.StatusCode >= 400 {
-		b, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("consul GET %s failed: %s: %s", u, resp.Status, strings.TrimSpace(string(b)))
+		return false, fmt.Errorf("consul PUT %s failed: %s: %s", u, resp.Status, strings.TrimSpace(string(b)))
 	}
 
-	var out map[string]AgentServiceInfo
-	err = json.NewDecoder(resp.Body).Decode(&out)
+	return strings.TrimSpace(string(b)) == "true", nil
+}
+
+func (c *ConsulClient) get(ctx context.Context, path string, q url.Values, out any) (int, error) {
+	u := c.base + path
+	if q != nil {
+		u += "?" + q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
 	}
 
-	return out, nil
+	resp, err := c.send(req, path)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, fmt.Errorf("consul GET %s failed: %s: %s", u, resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send performs req in a span and reports its latency under path.
+func (c *ConsulClient) send(req *http.Request, path string) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), "consul.request", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", req.Method),
+		attribute.String("url.path", path),
+	))
+	start := time.Now()
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if c.observe != nil {
+		c.observe(req.Method, path, time.Since(start))
+	}
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	endSpan(span, err)
+	return resp, err
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeregisterServiceNotFound(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		wantErr      bool
+		wantNotFound bool
+	}{
+		{name: "removed", status: http.StatusOK},
+		{name: "already gone", status: http.StatusNotFound, wantErr: true, wantNotFound: true},
+		{name: "forbidden", status: http.StatusForbidden, wantErr: true},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			err := NewConsulClient(srv.URL, "", 5*time.Second, false).DeregisterService(context.Background(), "web:1", "", "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := isNotFound(err); got != tt.wantNotFound {
+				t.Errorf("isNotFound(%v) = %v, want %v", err, got, tt.wantNotFound)
+			}
+		})
+	}
+}
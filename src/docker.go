@@ -3,18 +3,26 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type DockerClient struct {
 	client *http.Client
+	// stream shares the transport but has no overall timeout, for
+	// long-lived responses such as the events stream.
+	stream *http.Client
 }
 
 func NewDockerClient(sock string, timeout time.Duration) *DockerClient {
@@ -28,6 +36,9 @@ func NewDockerClient(sock string, timeout time.Duration) *DockerClient {
 			Transport: tr,
 			Timeout:   timeout,
 		},
+		stream: &http.Client{
+			Transport: tr,
+		},
 	}
 }
 
@@ -38,9 +49,12 @@ type DockerContainer struct {
 }
 
 type DockerInspect struct {
-	ID   string `json:"Id"`
-	Name string `json:"Name"`
-	Config struct {
+	ID           string `json:"Id"`
+	Name         string `json:"Name"`
+	Image        string `json:"Image"`
+	RestartCount int    `json:"RestartCount"`
+	Config       struct {
+		Image       string            `json:"Image"`
 		Labels      map[string]string `json:"Labels"`
 		Healthcheck *struct {
 			Interval int64 `json:"Interval"`
@@ -49,7 +63,14 @@ type DockerInspect struct {
 		} `json:"Healthcheck"`
 	} `json:"Config"`
 	State struct {
-		Health *struct {
+		Status     string    `json:"Status"`
+		Running    bool      `json:"Running"`
+		Restarting bool      `json:"Restarting"`
+		OOMKilled  bool      `json:"OOMKilled"`
+		ExitCode   int       `json:"ExitCode"`
+		Error      string    `json:"Error"`
+		StartedAt  time.Time `json:"StartedAt"`
+		Health     *struct {
 			Status string `json:"Status"`
 		} `json:"Health"`
 	} `json:"State"`
@@ -60,9 +81,18 @@ type DockerInspect struct {
 	} `json:"NetworkSettings"`
 }
 
-func (d *DockerClient) ListContainers(ctx context.Context) ([]DockerContainer, error) {
+// ListContainers lists all containers, running or not, matching filters
+// (e.g. "label": {"a=b"}), if any.
+func (d *DockerClient) ListContainers(ctx context.Context, filters map[string][]string) ([]DockerContainer, error) {
 	q := url.Values{}
 	q.Set("all", "1")
+	if len(filters) > 0 {
+		b, err := json.Marshal(filters)
+		if err != nil {
+			return nil, err
+		}
+		q.Set("filters", string(b))
+	}
 
 	resp, err := d.do(ctx, "GET", "/containers/json", q)
 	if err != nil {
@@ -87,7 +117,37 @@ func (d *DockerClient) Inspect(ctx context.Context, id string) (*DockerInspect,
 	return &out, err
 }
 
-func (d *DockerClient) do(ctx context.Context, method, path string, q url.Values) (*http.Response, error) {
+// ImageRepoDigests returns the repository digests ("repo@sha256:...") of an
+// image, empty for images that were never pushed or pulled.
+func (d *DockerClient) ImageRepoDigests(ctx context.Context, id string) ([]string, error) {
+	resp, err := d.do(ctx, "GET", "/images/"+id+"/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("docker image inspect failed: %s", resp.Status)
+	}
+
+	var out struct {
+		RepoDigests []string `json:"RepoDigests"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	return out.RepoDigests, err
+}
+
+func (d *DockerClient) do(ctx context.Context, method, path string, q url.Values) (resp *http.Response, err error) {
+	ctx, span := tracer.Start(ctx, "docker.request", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", method),
+		attribute.String("url.path", path),
+	))
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		}
+		endSpan(span, err)
+	}()
+
 	u := "http://unix" + path
 	if q != nil {
 		u += "?" + q.Encode()
@@ -133,6 +193,113 @@ func (d *DockerClient) StartContainer(ctx context.Context, idOrName string) erro
 	return fmt.Errorf("start failed for %s: %s", idOrName, resp.Status)
 }
 
+// Logs returns the last tail lines of the container's stdout and stderr.
+func (d *DockerClient) Logs(ctx context.Context, id string, tail int) (string, error) {
+	q := url.Values{}
+	q.Set("stdout", "1")
+	q.Set("stderr", "1")
+	q.Set("tail", strconv.Itoa(tail))
+
+	resp, err := d.do(ctx, "GET", "/containers/"+id+"/logs", q)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("logs failed for %s: %s", id, resp.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	return string(demuxDockerLogs(b)), nil
+}
+
+// demuxDockerLogs strips the 8-byte frame headers Docker prepends to each
+// chunk of a non-TTY container's output. TTY output is returned as is.
+func demuxDockerLogs(b []byte) []byte {
+	var out []byte
+	for len(b) > 0 {
+		if len(b) < 8 || b[0] > 2 || b[1] != 0 || b[2] != 0 || b[3] != 0 {
+			return append(out, b...)
+		}
+		size := int(binary.BigEndian.Uint32(b[4:8]))
+		b = b[8:]
+		if size > len(b) {
+			size = len(b)
+		}
+		out = append(out, b[:size]...)
+		b = b[size:]
+	}
+	return out
+}
+
+// DockerEvent is a container event from the /events stream.
+type DockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// Events streams container events until ctx is done or the connection
+// drops. The events channel is closed when the stream ends; the error
+// channel then receives the reason, if any.
+func (d *DockerClient) Events(ctx context.Context, actions ...string) (<-chan DockerEvent, <-chan error) {
+	events := make(chan DockerEvent)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(events)
+		defer close(errc)
+
+		filters, _ := json.Marshal(map[string][]string{
+			"type":  {"container"},
+			"event": actions,
+		})
+		q := url.Values{}
+		q.Set("filters", string(filters))
+
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://unix/events?"+q.Encode(), nil)
+		if err != nil {
+			errc <- err
+			return
+		}
+		resp, err := d.stream.Do(req)
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			errc <- fmt.Errorf("docker events failed: %s", resp.Status)
+			return
+		}
+
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var ev DockerEvent
+			if err := dec.Decode(&ev); err != nil {
+				if ctx.Err() == nil {
+					errc <- err
+				}
+				return
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, errc
+}
+
 func normalizeAddr(in string) string {
 	in = strings.TrimSpace(in)
 	if in == "" {
@@ -148,112 +315,63 @@ func normalizeAddr(in string) string {
 	return in
 }
 
-func (d *DockerClient) LaunchSidecar(ctx context.Context, parentID, name, serviceID string, cfg *Config, needsNetAdmin bool) error {
-	containerName := "consul_sidecar-" + strings.ReplaceAll(serviceID, ":", "_")
-
-	grpcAddr := normalizeAddr(cfg.SidecarGrpcAddr)
-	httpAddr := strings.TrimSpace(cfg.SidecarHttpAddr)
-
-	entrypoint := []string{"/bin/sh", "-c"}
-	proxyServiceID := serviceID + "-sidecar-proxy"
-
-	proxyUID := 1337
-	proxyUser := "envoy"
-
-	redirectCmd := fmt.Sprintf(
-		"consul connect redirect-traffic -proxy-id %s -proxy-uid  %d "+
-			"-exclude-inbound-port 19100 "+
-			"-exclude-inbound-port 20200",
-		proxyServiceID,
-		proxyUID,
-	)
-
-	envoyCmd := fmt.Sprintf(
-		"consul connect envoy -sidecar-for %s "+
-			"-admin-bind 127.0.0.1:19000 "+
-			"-envoy-ready-bind-address 0.0.0.0 "+
-			"-envoy-ready-bind-port 19100 "+
-			"-grpc-addr %s "+
-			"-http-addr %s",
-		serviceID, grpcAddr, httpAddr,
-	)
-
-	if cfg.SidecarGrpcTLS && cfg.SidecarCAPath != "" {
-		envoyCmd += fmt.Sprintf(" -grpc-ca-file %s", cfg.SidecarCAPath)
+// createContainer creates a container and returns its ID. The HTTP status is
+// returned alongside errors so callers can handle name conflicts.
+func (d *DockerClient) createContainer(ctx context.Context, name string, config map[string]interface{}) (string, int, error) {
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(config); err != nil {
+		return "", 0, err
 	}
 
-	cmd := []string{
-		fmt.Sprintf(
-			// crée l'user si besoin, applique iptables, puis lance envoy en non-root
-			"adduser -D -u %d %s 2>/dev/null || true; "+
-				"%s && su %s -s /bin/sh -c %q",
-			proxyUID, proxyUser,
-			redirectCmd,
-			proxyUser,
-			envoyCmd,
-		),
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://unix/containers/create?name="+url.QueryEscape(name), buf)
+	if err != nil {
+		return "", 0, err
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	hostConfig := map[string]interface{}{
-		"NetworkMode":   "container:" + parentID,
-		"RestartPolicy": map[string]string{"Name": "unless-stopped"},
+	r, err := d.client.Do(req)
+	if err != nil {
+		return "", 0, err
 	}
+	defer r.Body.Close()
 
-	if needsNetAdmin {
-		capAdd, _ := hostConfig["CapAdd"].([]string)
-		capAdd = append(capAdd, "NET_ADMIN")
-		hostConfig["CapAdd"] = capAdd
-
-		secOpt, _ := hostConfig["SecurityOpt"].([]string)
-		secOpt = append(secOpt, "no-new-privileges:true")
-		hostConfig["SecurityOpt"] = secOpt
+	if r.StatusCode >= 400 {
+		b, _ := io.ReadAll(r.Body)
+		return "", r.StatusCode, fmt.Errorf("create %s failed: %s: %s", name, r.Status, strings.TrimSpace(string(b)))
 	}
 
-
-
-	config := map[string]interface{}{
-		"Image":      cfg.SidecarImage,
-		"Entrypoint": entrypoint,
-		"Cmd":        cmd,
-		"Env": []string{
-			"SERVICE_NAME=" + name,
-			"CONSUL_HTTP_ADDR=" + httpAddr,
-			"CONSUL_GRPC_ADDR=" + grpcAddr,
-		},
-		"HostConfig": hostConfig,
-		"Labels": map[string]string{
-			"consul-registrator": "sidecar",
-			"service-id":         serviceID,
-		},
+	var created struct {
+		ID string `json:"Id"`
 	}
-
-	buf := new(bytes.Buffer)
-	if err := json.NewEncoder(buf).Encode(config); err != nil {
-		return err
+	if err := json.NewDecoder(r.Body).Decode(&created); err != nil {
+		return "", r.StatusCode, err
 	}
-	log.Printf("creating sidecar container name=%s with config:\n%s", containerName, buf.String())
+	return created.ID, r.StatusCode, nil
+}
 
-	r, err := d.client.Post("http://unix/containers/create?name="+containerName, "application/json", buf)
+// WaitContainer blocks until the container stops and returns its exit code.
+func (d *DockerClient) WaitContainer(ctx context.Context, id string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://unix/containers/"+id+"/wait", nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	defer r.Body.Close()
-
-	if r.StatusCode == 409 {
-		return d.StartContainer(ctx, containerName)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
 	}
-	if r.StatusCode >= 400 {
-		return fmt.Errorf("create failed: %s", r.Status)
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return 0, fmt.Errorf("wait failed for %s: %s", id, resp.Status)
 	}
 
-	var created struct {
-		ID string `json:"Id"`
+	var out struct {
+		StatusCode int `json:"StatusCode"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&created); err != nil {
-		return err
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, err
 	}
-
-	return d.StartContainer(ctx, created.ID)
+	return out.StatusCode, nil
 }
 
 func (d *DockerClient) RemoveContainer(ctx context.Context, id string) error {
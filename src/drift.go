@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// fieldDiff is one difference between the computed payload of a service and
+// the definition currently held by the Consul agent.
+type fieldDiff struct {
+	Field string
+	Want  string
+	Got   string
+}
+
+// diffService compares the computed payload with the live agent definition
+// field by field. A nil live definition means the service is missing.
+func diffService(svc map[string]any, live *AgentServiceInfo) []fieldDiff {
+	if live == nil {
+		return []fieldDiff{{Field: "service", Want: "registered", Got: "missing"}}
+	}
+
+	var diffs []fieldDiff
+	add := func(field, want, got string) {
+		if want != got {
+			diffs = append(diffs, fieldDiff{Field: field, Want: want, Got: got})
+		}
+	}
+
+	name, _ := svc["name"].(string)
+	add("name", name, live.Service)
+
+	port := intFromAny(svc["port"])
+	if port == 0 {
+		port = intFromAny(svc["Port"])
+	}
+	add("port", fmt.Sprint(port), fmt.Sprint(live.Port))
+
+	addr, _ := svc["address"].(string)
+	if addr == "" {
+		addr, _ = svc["Address"].(string)
+	}
+	add("address", addr, live.Address)
+
+	wantTags := stringsFromAny(svc["Tags"])
+	if wantTags == nil {
+		wantTags = stringsFromAny(svc["tags"])
+	}
+	missing, extra := diffStringSets(wantTags, live.Tags)
+	for _, t := range missing {
+		add("tags", t, "")
+	}
+	for _, t := range extra {
+		add("tags", "", t)
+	}
+
+	wantMeta := stringMapFromAny(svc["Meta"])
+	if wantMeta == nil {
+		wantMeta = stringMapFromAny(svc["meta"])
+	}
+	keys := map[string]bool{}
+	for k := range wantMeta {
+		keys[k] = true
+	}
+	for k := range live.Meta {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		add("meta."+k, wantMeta[k], live.Meta[k])
+	}
+
+	return diffs
+}
+
+// diffStringSets returns the elements of want missing from got, and the
+// elements of got not in want, both sorted.
+func diffStringSets(want, got []string) (missing, extra []string) {
+	w := map[string]bool{}
+	for _, s := range want {
+		w[s] = true
+	}
+	g := map[string]bool{}
+	for _, s := range got {
+		g[s] = true
+	}
+	for s := range w {
+		if !g[s] {
+			missing = append(missing, s)
+		}
+	}
+	for s := range g {
+		if !w[s] {
+			extra = append(extra, s)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return missing, extra
+}
+
+func stringMapFromAny(v any) map[string]string {
+	switch x := v.(type) {
+	case map[string]string:
+		return x
+	case map[string]any:
+		out := make(map[string]string, len(x))
+		for k, it := range x {
+			out[k] = fmt.Sprint(it)
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+func logDrift(containerID, serviceName, serviceID string, diffs []fieldDiff) {
+	parts := make([]string, 0, len(diffs))
+	for _, d := range diffs {
+		parts = append(parts, fmt.Sprintf("%s: want=%q got=%q", d.Field, d.Want, d.Got))
+	}
+	slog.Warn("drift detected", "container", containerID, "service", serviceName, "service_id", serviceID,
+		"fields", len(diffs), "diff", strings.Join(parts, "; "))
+}
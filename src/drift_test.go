@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffService(t *testing.T) {
+	live := &AgentServiceInfo{
+		Service: "web",
+		Port:    80,
+		Address: "10.0.0.2",
+		Tags:    []string{"a", "b"},
+		Meta:    map[string]string{"version": "1"},
+	}
+
+	tests := []struct {
+		name string
+		svc  map[string]any
+		live *AgentServiceInfo
+		want []fieldDiff
+	}{
+		{
+			name: "missing",
+			svc:  map[string]any{"name": "web"},
+			want: []fieldDiff{{Field: "service", Want: "registered", Got: "missing"}},
+		},
+		{
+			name: "in sync",
+			svc: map[string]any{
+				"name": "web", "port": 80, "address": "10.0.0.2",
+				"tags": []any{"b", "a"}, "meta": map[string]any{"version": "1"},
+			},
+			live: live,
+		},
+		{
+			name: "capitalized keys",
+			svc: map[string]any{
+				"name": "web", "Port": 80, "Address": "10.0.0.2",
+				"Tags": []string{"a", "b"}, "Meta": map[string]string{"version": "1"},
+			},
+			live: live,
+		},
+		{
+			name: "port and address",
+			svc: map[string]any{
+				"name": "web", "port": 8080, "address": "10.0.0.3",
+				"tags": []any{"a", "b"}, "meta": map[string]any{"version": "1"},
+			},
+			live: live,
+			want: []fieldDiff{
+				{Field: "port", Want: "8080", Got: "80"},
+				{Field: "address", Want: "10.0.0.3", Got: "10.0.0.2"},
+			},
+		},
+		{
+			name: "tags and meta",
+			svc: map[string]any{
+				"name": "web", "port": 80, "address": "10.0.0.2",
+				"tags": []any{"a", "c"}, "meta": map[string]any{"version": "2", "team": "x"},
+			},
+			live: live,
+			want: []fieldDiff{
+				{Field: "tags", Want: "c"},
+				{Field: "tags", Got: "b"},
+				{Field: "meta.team", Want: "x"},
+				{Field: "meta.version", Want: "2", Got: "1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffService(tt.svc, tt.live); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffService() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// eventDebounce is how long the main loop waits after a Docker event before
+// reconciling, so a burst of events (die, start, ...) leads to one cycle.
+const eventDebounce = time.Second
+
+// watchDockerEvents follows the Docker events stream and signals trigger when
+// a container declaring services under labelPrefix or a sidecar starts,
+// restarts, dies or is destroyed. The stream is reopened with backoff until
+// ctx is done.
+func watchDockerEvents(ctx context.Context, docker *DockerClient, labelPrefix string, metrics *Metrics, trigger chan<- struct{}) {
+	backoff := time.Second
+	for {
+		events, errc := docker.Events(ctx, "start", "restart", "die", "destroy")
+		for ev := range events {
+			backoff = time.Second
+			if !isRelevantEvent(ev, labelPrefix) {
+				continue
+			}
+			metrics.Events.Inc()
+			slog.Debug("docker event", "container", ev.Actor.ID, "action", ev.Action)
+			select {
+			case trigger <- struct{}{}:
+			default:
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err := <-errc; err != nil {
+			slog.Warn("docker events stream ended, retrying", "backoff", backoff, "error", err)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// isRelevantEvent reports whether the event concerns a container declaring
+// services or one of our sidecars. Event attributes carry container labels.
+func isRelevantEvent(ev DockerEvent, labelPrefix string) bool {
+	for k, v := range ev.Actor.Attributes {
+		if strings.HasPrefix(k, labelPrefix+".service.") {
+			return true
+		}
+		if k == "consul-registrator" && v == "sidecar" {
+			return true
+		}
+	}
+	return false
+}
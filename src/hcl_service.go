@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hclparse"
@@ -9,7 +10,78 @@ import (
 	"github.com/zclconf/go-cty/cty"
 )
 
-func ParseServiceHCL(input string) (map[string]any, error) {
+// ServiceLabel is a parsed consul.service.<name> label.
+type ServiceLabel struct {
+	// Service is the service definition.
+	Service       map[string]any
+	ConfigEntries []ConfigEntry
+	// Upstreams are the upstream blocks, to add to the sidecar proxy.
+	Upstreams []map[string]any
+}
+
+// ParseServiceHCL parses the value of a consul.service.<name> label. Its
+// config_entry and upstream blocks are returned apart from the service
+// definition.
+func ParseServiceHCL(input string) (*ServiceLabel, error) {
+	blk, err := findLabelBlock(input, "service")
+	if err != nil {
+		return nil, err
+	}
+
+	body, entryBlocks := splitBlocks(blk.Body, "config_entry")
+	body, upstreamBlocks := splitBlocks(body, "upstream")
+	svc, err := hclBodyToMap(body)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseConfigEntries(entryBlocks)
+	if err != nil {
+		return nil, err
+	}
+	upstreams, err := parseUpstreamBlocks(upstreamBlocks)
+	if err != nil {
+		return nil, err
+	}
+	return &ServiceLabel{Service: svc, ConfigEntries: entries, Upstreams: upstreams}, nil
+}
+
+// ParseSidecarHCL parses the value of a consul.sidecar.<name> label. The
+// label may also be empty or a plain boolean ("true", or "false" to not run
+// a sidecar), in which case there are no overrides and nil is returned.
+func ParseSidecarHCL(input string) (map[string]any, error) {
+	switch strings.ToLower(strings.TrimSpace(input)) {
+	case "", "true", "1", "yes", "on", "enabled":
+		return nil, nil
+	}
+	if sidecarDisabled(input) {
+		return nil, nil
+	}
+	return parseLabelBlock(input, "sidecar")
+}
+
+// sidecarDisabled reports whether a consul.sidecar.<name> label value turns
+// the sidecar off, as if the label was not set.
+func sidecarDisabled(input string) bool {
+	switch strings.ToLower(strings.TrimSpace(input)) {
+	case "false", "0", "no", "off", "disabled":
+		return true
+	}
+	return false
+}
+
+// parseLabelBlock parses an HCL label value containing a single block of the
+// given type and returns its body as a map.
+func parseLabelBlock(input, blockType string) (map[string]any, error) {
+	blk, err := findLabelBlock(input, blockType)
+	if err != nil {
+		return nil, err
+	}
+	return hclBodyToMap(blk.Body)
+}
+
+// findLabelBlock parses an HCL label value and returns its single block of
+// the given type.
+func findLabelBlock(input, blockType string) (*hclsyntax.Block, error) {
 	parser := hclparse.NewParser()
 	f, diags := parser.ParseHCL([]byte(input), "label.hcl")
 	if diags.HasErrors() {
@@ -21,28 +93,50 @@ func ParseServiceHCL(input string) (map[string]any, error) {
 		return nil, fmt.Errorf("invalid HCL body")
 	}
 
-	var svc *hclsyntax.Block
+	var blk *hclsyntax.Block
 	for _, b := range body.Blocks {
-		if b.Type == "service" {
-			if svc != nil {
-				return nil, fmt.Errorf("multiple service blocks")
+		if b.Type == blockType {
+			if blk != nil {
+				return nil, fmt.Errorf("multiple %s blocks", blockType)
 			}
-			svc = b
+			blk = b
 		}
 	}
 
-	if svc == nil {
-		return nil, fmt.Errorf("missing service block")
+	if blk == nil {
+		return nil, fmt.Errorf("missing %s block", blockType)
 	}
+	return blk, nil
+}
 
-	return hclBodyToMap(svc.Body)
+// splitBlocks returns body without its blocks of type blockType, and those
+// blocks. hclBodyToMap drops block labels and keeps one block per type, so
+// labeled or repeated blocks are decoded apart.
+func splitBlocks(body *hclsyntax.Body, blockType string) (*hclsyntax.Body, []*hclsyntax.Block) {
+	rest := *body
+	rest.Blocks = nil
+	var blocks []*hclsyntax.Block
+	for _, b := range body.Blocks {
+		if b.Type == blockType {
+			blocks = append(blocks, b)
+		} else {
+			rest.Blocks = append(rest.Blocks, b)
+		}
+	}
+	return &rest, blocks
 }
 
 func hclBodyToMap(body *hclsyntax.Body) (map[string]any, error) {
+	return hclBodyToMapWithContext(body, &hcl.EvalContext{})
+}
+
+// hclBodyToMapWithContext is hclBodyToMap with variables available to
+// expressions, e.g. "${service_id}".
+func hclBodyToMapWithContext(body *hclsyntax.Body, evalCtx *hcl.EvalContext) (map[string]any, error) {
 	out := map[string]any{}
 
 	for k, a := range body.Attributes {
-		v, diags := a.Expr.Value(&hcl.EvalContext{})
+		v, diags := a.Expr.Value(evalCtx)
 		if diags.HasErrors() {
 			return nil, fmt.Errorf(diags.Error())
 		}
@@ -51,7 +145,7 @@ func hclBodyToMap(body *hclsyntax.Body) (map[string]any, error) {
 	}
 
 	for _, b := range body.Blocks {
-		child, err := hclBodyToMap(b.Body)
+		child, err := hclBodyToMapWithContext(b.Body, evalCtx)
 		if err != nil {
 			return nil, err
 		}
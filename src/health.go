@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health tracks the outcome of reconciliation cycles for the /readyz
+// endpoint. It is updated by the agent and read by HTTP handlers.
+type Health struct {
+	mu          sync.Mutex
+	window      time.Duration
+	lastSuccess time.Time
+	lastErr     error
+	dockerErr   error
+	consulErr   error
+}
+
+// NewHealth returns a Health that reports ready as long as a reconcile
+// succeeded within window.
+func NewHealth(window time.Duration) *Health {
+	return &Health{window: window}
+}
+
+func (h *Health) SetWindow(window time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.window = window
+}
+
+func (h *Health) RecordReconcile(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastErr = err
+	if err == nil {
+		h.lastSuccess = time.Now()
+	}
+}
+
+func (h *Health) RecordDocker(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dockerErr = err
+}
+
+func (h *Health) RecordConsul(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.consulErr = err
+}
+
+// readiness is the /readyz response. Ready requires the last reconcile to
+// have succeeded, a successful one within the window, and Docker and Consul
+// to have been reachable during the last cycle.
+type readiness struct {
+	Ready       bool       `json:"ready"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	Problems    []string   `json:"problems,omitempty"`
+}
+
+func (h *Health) readiness(now time.Time) readiness {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var r readiness
+	if h.lastSuccess.IsZero() {
+		r.Problems = append(r.Problems, "no successful reconcile yet")
+	} else {
+		last := h.lastSuccess
+		r.LastSuccess = &last
+		if age := now.Sub(last); age > h.window {
+			r.Problems = append(r.Problems, fmt.Sprintf("last successful reconcile %s ago (max %s)", age.Round(time.Second), h.window))
+		}
+	}
+	if h.lastErr != nil {
+		r.Problems = append(r.Problems, "last reconcile failed: "+h.lastErr.Error())
+	}
+	if h.dockerErr != nil {
+		r.Problems = append(r.Problems, "docker unreachable: "+h.dockerErr.Error())
+	}
+	if h.consulErr != nil {
+		r.Problems = append(r.Problems, "consul unreachable: "+h.consulErr.Error())
+	}
+	r.Ready = len(r.Problems) == 0
+	return r
+}
+
+func (h *Health) serveHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (h *Health) serveReadyz(w http.ResponseWriter, _ *http.Request) {
+	r := h.readiness(time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	if !r.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(r)
+}
+
+// probeReady queries the /readyz endpoint of a running registrator listening
+// on metricsAddr. It backs the -healthcheck flag.
+func probeReady(ctx context.Context, metricsAddr string) error {
+	host, port, err := net.SplitHostPort(metricsAddr)
+	if err != nil {
+		return err
+	}
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+net.JoinHostPort(host, port)+"/readyz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var r readiness
+		_ = json.NewDecoder(resp.Body).Decode(&r)
+		return fmt.Errorf("not ready: %s %v", resp.Status, r.Problems)
+	}
+	return nil
+}
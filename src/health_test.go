@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthReadiness(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	unreachable := errors.New("connection refused")
+
+	tests := []struct {
+		name         string
+		lastSuccess  time.Duration // ago, 0 for never
+		lastErr      error
+		dockerErr    error
+		consulErr    error
+		wantProblems []string
+	}{
+		{
+			name:         "never reconciled",
+			wantProblems: []string{"no successful reconcile yet"},
+		},
+		{
+			name:        "recent success",
+			lastSuccess: 10 * time.Second,
+		},
+		{
+			name:         "last cycle failed",
+			lastSuccess:  20 * time.Second,
+			lastErr:      unreachable,
+			wantProblems: []string{"last reconcile failed: connection refused"},
+		},
+		{
+			name:         "docker unreachable",
+			lastSuccess:  20 * time.Second,
+			lastErr:      unreachable,
+			dockerErr:    unreachable,
+			wantProblems: []string{"last reconcile failed: connection refused", "docker unreachable: connection refused"},
+		},
+		{
+			name:         "consul unreachable",
+			lastSuccess:  10 * time.Second,
+			consulErr:    unreachable,
+			wantProblems: []string{"consul unreachable: connection refused"},
+		},
+		{
+			name:         "stale",
+			lastSuccess:  41 * time.Second,
+			wantProblems: []string{"last successful reconcile 41s ago (max 30s)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHealth(30 * time.Second)
+			if tt.lastSuccess != 0 {
+				h.lastSuccess = now.Add(-tt.lastSuccess)
+			}
+			h.lastErr = tt.lastErr
+			h.RecordDocker(tt.dockerErr)
+			h.RecordConsul(tt.consulErr)
+
+			r := h.readiness(now)
+			if r.Ready != (len(tt.wantProblems) == 0) {
+				t.Errorf("ready = %v with problems %q", r.Ready, r.Problems)
+			}
+			if !reflect.DeepEqual(r.Problems, tt.wantProblems) {
+				t.Errorf("problems = %q, want %q", r.Problems, tt.wantProblems)
+			}
+		})
+	}
+}
+
+func TestRunConsulFailureNotReady(t *testing.T) {
+	consul := &fakeConsul{}
+	var failing atomic.Bool
+	a := newTestAgent(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "no leader", http.StatusInternalServerError)
+			return
+		}
+		consul.ServeHTTP(w, r)
+	}))
+
+	if err := a.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if r := a.health.readiness(time.Now()); !r.Ready {
+		t.Fatalf("not ready after a successful cycle: %q", r.Problems)
+	}
+
+	failing.Store(true)
+	_ = a.Run(context.Background())
+	if r := a.health.readiness(time.Now()); r.Ready {
+		t.Error("ready while consul fails")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// logLevel is shared by the handlers so a reload can change the level.
+var logLevel slog.LevelVar
+
+// secretKey matches attribute and payload keys whose values are never logged.
+var secretKey = regexp.MustCompile(`(?i)(token|secret|passw(or)?d|credential|authorization|api[_-]?key|private[_-]?key)`)
+
+const redacted = "[REDACTED]"
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return 0, fmt.Errorf("invalid log level %q (want debug, info, warn or error)", s)
+	}
+	return l, nil
+}
+
+// setupLogging installs the default slog logger, which the log package also
+// writes through. format is "text" or "json". Records logged with a traced
+// context carry its trace_id and span_id.
+func setupLogging(w io.Writer, format, level string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(l)
+
+	opts := &slog.HandlerOptions{Level: &logLevel, ReplaceAttr: redactAttr}
+	var h slog.Handler
+	switch format {
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text", "":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q (want text or json)", format)
+	}
+	slog.SetDefault(slog.New(traceHandler{h}))
+	return nil
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindString && secretKey.MatchString(a.Key) && a.Value.String() != "" {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+// redactPayload returns a copy of a service payload or container config
+// that is safe to log: values under secret-like keys, environment values and
+// HTTP check headers are replaced.
+func redactPayload(v any) any {
+	switch x := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(x))
+		for k, it := range x {
+			switch {
+			case secretKey.MatchString(k):
+				out[k] = redacted
+			case strings.EqualFold(k, "env"):
+				out[k] = redactEnv(it)
+			case strings.EqualFold(k, "header"):
+				out[k] = redactValues(it)
+			default:
+				out[k] = redactPayload(it)
+			}
+		}
+		return out
+	case map[string]string:
+		out := make(map[string]string, len(x))
+		for k, it := range x {
+			if secretKey.MatchString(k) {
+				it = redacted
+			}
+			out[k] = it
+		}
+		return out
+	case []any:
+		out := make([]any, len(x))
+		for i, it := range x {
+			out[i] = redactPayload(it)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// redactEnv keeps the variable names of a Docker Env list or an env map.
+func redactEnv(v any) any {
+	switch x := v.(type) {
+	case []string:
+		out := make([]string, len(x))
+		for i, kv := range x {
+			name, _, _ := strings.Cut(kv, "=")
+			out[i] = name + "=" + redacted
+		}
+		return out
+	case []any:
+		out := make([]any, len(x))
+		for i, it := range x {
+			s, _ := it.(string)
+			name, _, _ := strings.Cut(s, "=")
+			out[i] = name + "=" + redacted
+		}
+		return out
+	default:
+		return redactValues(v)
+	}
+}
+
+func redactValues(v any) any {
+	switch x := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(x))
+		for k := range x {
+			out[k] = redacted
+		}
+		return out
+	case map[string]string:
+		out := make(map[string]string, len(x))
+		for k := range x {
+			out[k] = redacted
+		}
+		return out
+	default:
+		return redacted
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log/slog"
+	"reflect"
+	"testing"
+)
+
+func TestRedactPayload(t *testing.T) {
+	tests := []struct {
+		name string
+		in   any
+		want any
+	}{
+		{
+			name: "secret keys",
+			in:   map[string]any{"name": "web", "Token": "t", "db_password": "p", "port": 80},
+			want: map[string]any{"name": "web", "Token": redacted, "db_password": redacted, "port": 80},
+		},
+		{
+			name: "nested meta",
+			in:   map[string]any{"meta": map[string]string{"api-key": "k", "version": "1"}},
+			want: map[string]any{"meta": map[string]string{"api-key": redacted, "version": "1"}},
+		},
+		{
+			name: "docker env list",
+			in:   map[string]any{"Env": []string{"A=1", "B"}},
+			want: map[string]any{"Env": []string{"A=" + redacted, "B=" + redacted}},
+		},
+		{
+			name: "env map",
+			in:   map[string]any{"env": map[string]string{"FOO": "bar"}},
+			want: map[string]any{"env": map[string]string{"FOO": redacted}},
+		},
+		{
+			name: "check headers",
+			in: map[string]any{"checks": []any{
+				map[string]any{"HTTP": "http://web/health", "header": map[string]any{"X-Key": []any{"v"}}},
+			}},
+			want: map[string]any{"checks": []any{
+				map[string]any{"HTTP": "http://web/health", "header": map[string]any{"X-Key": redacted}},
+			}},
+		},
+		{name: "scalar", in: "plain", want: "plain"},
+		{name: "nil", in: nil, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactPayload(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("redactPayload() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactAttr(t *testing.T) {
+	tests := []struct {
+		attr slog.Attr
+		want string
+	}{
+		{slog.String("token", "t"), redacted},
+		{slog.String("CONSUL_HTTP_TOKEN", "t"), redacted},
+		{slog.String("token", ""), ""},
+		{slog.String("service", "web"), "web"},
+	}
+	for _, tt := range tests {
+		if got := redactAttr(nil, tt.attr).Value.String(); got != tt.want {
+			t.Errorf("redactAttr(%v) = %q, want %q", tt.attr, got, tt.want)
+		}
+	}
+}
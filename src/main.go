@@ -2,103 +2,326 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
+	def := defaultConfig()
+	flags := &cliFlags{
+		dockerSock:    flag.String("docker-socket", def.DockerSocket, "Docker socket path"),
+		consulAddr:    flag.String("consul-addr", def.ConsulAddr, "Consul HTTP address"),
+		statePath:     flag.String("state", def.StatePath, "State file path (default "+defaultStatePath+", or per label prefix)"),
+		stateBackend:  flag.String("state-backend", def.StateBackend, "State backend: file or consul"),
+		stateKVPrefix: flag.String("state-consul-prefix", def.StateConsulPrefix, "Consul KV prefix for the consul state backend (default "+defaultStateConsulPrefix+", or per label prefix)"),
+		metricsAddr:   flag.String("metrics-addr", def.MetricsAddr, "Prometheus metrics address"),
+		interval:      flag.Duration("interval", def.Interval, "Reconciliation polling interval"),
+		reRegister:    flag.Duration("reregister-interval", def.ReRegisterInterval, "How often each service is verified against the Consul agent"),
+		reJitter:      flag.Duration("reregister-jitter", def.ReRegisterJitter, "Maximum per-service offset added to the re-register interval"),
+	}
 	var (
-		dockerSockEnv  = getenv("DOCKER_SOCKET", "/var/run/docker.sock")
-		consulAddrEnv  = getenv("CONSUL_HTTP_ADDR", "http://localhost:8500")
-		statePathEnv   = getenv("STATE_PATH", "/tmp/registrator-state.json")
-		metricsAddrEnv = getenv("METRICS_ADDR", ":9090")
-	)
-
-	var (
-		dockerSock       = flag.String("docker-socket", dockerSockEnv, "Docker socket path")
-		consulAddr       = flag.String("consul-addr", consulAddrEnv, "Consul HTTP address")
-		statePath        = flag.String("state", statePathEnv, "State file path")
-		metricsAddr      = flag.String("metrics-addr", metricsAddrEnv, "Prometheus metrics address")
-		onceFlag         = flag.Bool("once", false, "Run only one reconciliation loop")
-		healthcheckFlag  = flag.Bool("healthcheck", false, "Exit 0 if registrator can reach Docker")
+		configPath      = flag.String("config", getenv("CONFIG_FILE", ""), "Optional HCL config file (reloaded on SIGHUP)")
+		onceFlag        = flag.Bool("once", false, "Run only one reconciliation loop")
+		healthcheckFlag = flag.Bool("healthcheck", false, "Exit 0 if the running registrator reports ready on /readyz")
 	)
 	flag.Parse()
+	flags.collect()
+
+	cfg, err := loadRuntimeConfig(*configPath, flags)
+	if err != nil {
+		if *healthcheckFlag {
+			os.Exit(1)
+		}
+		fatal("invalid config", "error", err)
+	}
 
 	if *healthcheckFlag {
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 		defer cancel()
-		docker := NewDockerClient(*dockerSock, 2*time.Second)
-		if _, err := docker.ListContainers(ctx); err != nil {
+		if err := probeReady(ctx, cfg.MetricsAddr); err != nil {
+			slog.Error("healthcheck failed", "error", err)
 			os.Exit(1)
 		}
 		os.Exit(0)
 	}
 
-	ServeMetrics(*metricsAddr)
+	if err := setupLogging(os.Stderr, cfg.LogFormat, cfg.LogLevel); err != nil {
+		fatal("logging", "error", err)
+	}
+	cfg.Log()
+
+	shutdownTracing, err := setupTracing(context.Background(), cfg)
+	if err != nil {
+		fatal("tracing", "error", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = shutdownTracing(ctx)
+	}()
+
+	health := NewHealth(cfg.readyWindow())
 	metrics := NewMetrics()
-	docker := NewDockerClient(*dockerSock, 5*time.Second)
-	consul := NewConsulClient(*consulAddr, "", 5*time.Second, false)
-	state, _ := LoadState(*statePath)
-	cfg := LoadConfig()
+	docker := NewDockerClient(cfg.DockerSocket, 5*time.Second)
+	targets, err := NewConsulTargets(cfg, metrics)
+	if err != nil {
+		fatal("consul targets", "error", err)
+	}
 
-	agent := NewAgent(docker, consul, metrics, state, *statePath, cfg)
+	stores, err := newStateStores(targets, cfg)
+	if err != nil {
+		fatal("state store", "error", err)
+	}
+	agent := NewAgent(docker, targets, metrics, health, loadStates(stores), stores, cfg)
+
+	reconcileNow := make(chan struct{}, 1)
+	admin := NewAdminAPI(agent, reconcileNow)
+	admin.Configure(cfg)
+	if err := ServeMetrics(cfg.MetricsAddr, health, admin); err != nil {
+		fatal("metrics server", "addr", cfg.MetricsAddr, "error", err)
+	}
 
 	if *onceFlag {
 		_ = agent.RunOnce()
 		return
 	}
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	trigger := make(chan struct{}, 1)
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	go watchDockerEvents(watchCtx, docker, cfg.LabelPrefix, metrics, trigger)
+
+	timer := time.NewTimer(0)
+	nextRun := time.Now()
 	for {
+		select {
+		case <-timer.C:
+		case <-reconcileNow:
+			// Requested through the admin API: run right away.
+			stopTimer(timer)
+		case <-trigger:
+			// Reconcile shortly after the event instead of waiting for the
+			// next tick, e.g. to move a sidecar into a restarted parent.
+			if time.Until(nextRun) > eventDebounce {
+				stopTimer(timer)
+				timer.Reset(eventDebounce)
+				nextRun = time.Now().Add(eventDebounce)
+			}
+			continue
+		case <-hup:
+			next, err := loadRuntimeConfig(*configPath, flags)
+			if err == nil {
+				err = checkReloadable(cfg, next)
+			}
+			if err != nil {
+				slog.Error("config reload rejected, keeping current config", "error", err)
+				continue
+			}
+			if err := setupLogging(os.Stderr, next.LogFormat, next.LogLevel); err != nil {
+				slog.Error("config reload rejected, keeping current config", "error", err)
+				continue
+			}
+			next.Log()
+			warnRestartRequired(cfg, next)
+			// reloaded holds the state stores of the new targets, if any.
+			var reloaded map[string]StateStore
+			if !sameTargets(cfg, next) {
+				t, err := NewConsulTargets(next, metrics)
+				if err != nil {
+					slog.Error("config reload rejected, keeping current config", "error", err)
+					continue
+				}
+				s, err := newStateStores(t, next)
+				if err != nil {
+					slog.Error("config reload rejected, keeping current config", "error", err)
+					continue
+				}
+				targets, reloaded = t, s
+			}
+			if next.DockerSocket != cfg.DockerSocket || next.LabelPrefix != cfg.LabelPrefix {
+				if next.DockerSocket != cfg.DockerSocket {
+					docker = NewDockerClient(next.DockerSocket, 5*time.Second)
+				}
+				stopWatch()
+				watchCtx, stopWatch = context.WithCancel(context.Background())
+				go watchDockerEvents(watchCtx, docker, next.LabelPrefix, metrics, trigger)
+			}
+			agent.Reload(docker, targets, reloaded, next)
+			health.SetWindow(next.readyWindow())
+			admin.Configure(next)
+			cfg = next
+			slog.Info("config reloaded")
+			stopTimer(timer)
+		}
+
 		_ = agent.RunOnce()
-		time.Sleep(10 * time.Second)
+		timer.Reset(cfg.Interval)
+		nextRun = time.Now().Add(cfg.Interval)
 	}
 }
 
-func getenv(key, fallback string) string {
-	if val := os.Getenv(key); val != "" {
-		return val
+// stopTimer stops t and drains its channel so it can be Reset safely.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
 	}
-	return fallback
 }
 
-type Config struct {
-	SidecarEnabled   bool
-	SidecarImage     string
-	SidecarHttpAddr  string
-	SidecarGrpcAddr  string
-	SidecarGrpcTLS   bool
-	SidecarCAPath    string
-	SidecarPrometheusBindAddr string
+// cliFlags holds the command-line flags that override the config file and
+// environment. Only flags given explicitly on the command line are applied.
+type cliFlags struct {
+	set map[string]bool
+
+	dockerSock    *string
+	consulAddr    *string
+	statePath     *string
+	stateBackend  *string
+	stateKVPrefix *string
+	metricsAddr   *string
+	interval      *time.Duration
+	reRegister    *time.Duration
+	reJitter      *time.Duration
+}
+
+func (f *cliFlags) collect() {
+	f.set = map[string]bool{}
+	flag.Visit(func(fl *flag.Flag) { f.set[fl.Name] = true })
+}
+
+func (f *cliFlags) apply(cfg *Config) {
+	if f.set["docker-socket"] {
+		cfg.DockerSocket = *f.dockerSock
+	}
+	if f.set["consul-addr"] {
+		cfg.ConsulAddr = *f.consulAddr
+	}
+	if f.set["state"] {
+		cfg.StatePath = *f.statePath
+	}
+	if f.set["state-backend"] {
+		cfg.StateBackend = *f.stateBackend
+	}
+	if f.set["state-consul-prefix"] {
+		cfg.StateConsulPrefix = *f.stateKVPrefix
+	}
+	if f.set["metrics-addr"] {
+		cfg.MetricsAddr = *f.metricsAddr
+	}
+	if f.set["interval"] {
+		cfg.Interval = *f.interval
+	}
+	if f.set["reregister-interval"] {
+		cfg.ReRegisterInterval = *f.reRegister
+	}
+	if f.set["reregister-jitter"] {
+		cfg.ReRegisterJitter = *f.reJitter
+	}
+}
+
+func loadRuntimeConfig(path string, flags *cliFlags) (*Config, error) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	flags.apply(cfg)
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// warnRestartRequired logs settings that a SIGHUP reload cannot apply.
+// checkReloadable rejects a reload that changes the state settings: the
+// state stores are built from them, and moving the state needs a restart.
+func checkReloadable(cur, next *Config) error {
+	if cur.StateBackend != next.StateBackend || cur.StatePath != next.StatePath || cur.StateConsulPrefix != next.StateConsulPrefix {
+		return errors.New("state settings changed, a restart is required")
+	}
+	return nil
 }
 
-func LoadConfig() *Config {
-	prom := os.Getenv("SIDECAR_PROMETHEUS_BIND_ADDR")
-	prom = strings.TrimSpace(prom)
-	switch strings.ToLower(prom) {
-	case "", "0", "off", "false", "disabled":
-		prom = ""
-	}
-
-	cfg := &Config{
-		SidecarEnabled:            os.Getenv("SIDECAR_ENABLED") == "true",
-		SidecarImage:              os.Getenv("SIDECAR_IMAGE"),
-		SidecarHttpAddr:           os.Getenv("SIDECAR_CONSUL_HTTP"),
-		SidecarGrpcAddr:           os.Getenv("SIDECAR_CONSUL_GRPC"),
-		SidecarGrpcTLS:            os.Getenv("SIDECAR_GRPC_TLS") == "true",
-		SidecarCAPath:             os.Getenv("SIDECAR_GRPC_CA_FILE"),
-		SidecarPrometheusBindAddr: prom,
-	}
-
-	log.Printf("config: SIDECAR_ENABLED=%v", cfg.SidecarEnabled)
-	log.Printf("config: SIDECAR_IMAGE=%q", cfg.SidecarImage)
-	log.Printf("config: SIDECAR_CONSUL_HTTP=%q", cfg.SidecarHttpAddr)
-	log.Printf("config: SIDECAR_CONSUL_GRPC=%q", cfg.SidecarGrpcAddr)
-	log.Printf("config: SIDECAR_GRPC_TLS=%v", cfg.SidecarGrpcTLS)
-	log.Printf("config: SIDECAR_GRPC_CA_FILE=%q", cfg.SidecarCAPath)
-	log.Printf("config: SIDECAR_PROMETHEUS_BIND_ADDR=%q", cfg.SidecarPrometheusBindAddr)
-
-	return cfg
+func warnRestartRequired(cur, next *Config) {
+	if cur.MetricsAddr != next.MetricsAddr {
+		slog.Warn("metrics address change requires a restart", "current", cur.MetricsAddr, "next", next.MetricsAddr)
+	}
+	if cur.TracingEnabled != next.TracingEnabled || cur.TracingEndpoint != next.TracingEndpoint || cur.TracingInsecure != next.TracingInsecure {
+		slog.Warn("tracing changes require a restart")
+	}
+}
+
+// newStateStores returns the state store of each target.
+func newStateStores(targets map[string]*ConsulClient, cfg *Config) (map[string]StateStore, error) {
+	stores := map[string]StateStore{}
+	for _, name := range cfg.targetNames() {
+		store, err := newStateStore(targets[name], name, cfg.StateBackend, cfg.StatePath, cfg.StateConsulPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", name, err)
+		}
+		stores[name] = store
+	}
+	return stores, nil
+}
+
+// loadStates loads the state of each target. A state that cannot be loaded
+// starts empty.
+func loadStates(stores map[string]StateStore) map[string]*State {
+	states := map[string]*State{}
+	for name, store := range stores {
+		st, err := store.Load(context.Background())
+		if err != nil {
+			if _, ok := store.(*ConsulKVStateStore); ok {
+				slog.Warn("state load failed, starting empty; the stored state is read again and merged before the first write", "target", name, "error", err)
+			} else {
+				slog.Warn("state load failed, starting empty; the state file is moved aside before the first write", "target", name, "error", err)
+			}
+		}
+		states[name] = st
+	}
+	splitByTarget(states)
+	return states
+}
+
+// newStateStore returns the state store of a target: the state file, or KV
+// key, of the default target, suffixed with the name of the others.
+func newStateStore(consul *ConsulClient, target, backend, path, kvPrefix string) (StateStore, error) {
+	switch strings.ToLower(strings.TrimSpace(backend)) {
+	case "", "file":
+		path = targetStatePath(path, target)
+		slog.Info("state store", "target", target, "backend", "file", "path", path)
+		return NewFileStateStore(path), nil
+	case "consul":
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		node, err := consul.NodeName(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("resolve consul node name: %w", err)
+		}
+		key := consulStateKey(kvPrefix, node)
+		if target != defaultTarget {
+			key += "/" + target
+		}
+		slog.Info("state store", "target", target, "backend", "consul", "key", key)
+		return NewConsulKVStateStore(consul, key), nil
+	default:
+		return nil, fmt.Errorf("unknown state backend %q (want file or consul)", backend)
+	}
+}
+
+func getenv(key, fallback string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return fallback
 }
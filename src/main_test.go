@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestCheckReloadable(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr bool
+	}{
+		{name: "unchanged", change: func(*Config) {}},
+		{name: "interval", change: func(c *Config) { c.Interval *= 2 }},
+		{name: "backend", change: func(c *Config) { c.StateBackend = "consul" }, wantErr: true},
+		{name: "path", change: func(c *Config) { c.StatePath = "/data/state.json" }, wantErr: true},
+		{name: "label prefix defaults", change: func(c *Config) { c.LabelPrefix = "dc2"; c.StatePath = ""; c.StateConsulPrefix = "" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cur := defaultConfig()
+			if err := cur.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			next := defaultConfig()
+			tt.change(next)
+			if err := next.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if err := checkReloadable(cur, next); (err != nil) != tt.wantErr {
+				t.Errorf("checkReloadable() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,19 +1,49 @@
 package main
 
 import (
+	"log/slog"
+	"net"
 	"net/http"
+	"strings"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Error classes used as the "class" label of dockconsul_errors_total.
+const (
+	errClassDocker  = "docker"
+	errClassConsul  = "consul"
+	errClassState   = "state"
+	errClassSidecar = "sidecar"
+	errClassLabel   = "label"
+)
+
 type Metrics struct {
-	Containers        prometheus.Gauge
-	Services          prometheus.Gauge
-	TTLChecks         prometheus.Gauge
-	Events            prometheus.Counter
-	Errors            prometheus.Counter
-	SidecarsLaunched  prometheus.Gauge
-	SidecarsDeleted   prometheus.Gauge
+	Containers       prometheus.Gauge
+	Services         *prometheus.GaugeVec
+	TTLChecks        *prometheus.GaugeVec
+	Events           prometheus.Counter
+	Errors           *prometheus.CounterVec
+	SidecarsLaunched *prometheus.GaugeVec
+	SidecarsDeleted  *prometheus.GaugeVec
+	Drift            *prometheus.CounterVec
+	ContainerStatus  *prometheus.GaugeVec
+
+	Registrations   *prometheus.CounterVec
+	Deregistrations *prometheus.CounterVec
+	Skips           *prometheus.CounterVec
+	ConfigEntries   *prometheus.CounterVec
+
+	ReconcileDuration     *prometheus.HistogramVec
+	DockerInspectDuration prometheus.Histogram
+	ConsulRequestDuration *prometheus.HistogramVec
+
+	// Per-service sidecar health, labeled by service_id.
+	SidecarUp       *prometheus.GaugeVec
+	SidecarRestarts *prometheus.GaugeVec
+	SidecarExitCode *prometheus.GaugeVec
 }
 
 func NewMetrics() *Metrics {
@@ -22,30 +52,81 @@ func NewMetrics() *Metrics {
 			Name: "dockconsul_containers_total",
 			Help: "Number of Docker containers observed",
 		}),
-		Services: prometheus.NewGauge(prometheus.GaugeOpts{
+		Services: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "dockconsul_services_registered_total",
-			Help: "Number of Consul services registered",
-		}),
-		TTLChecks: prometheus.NewGauge(prometheus.GaugeOpts{
+			Help: "Number of Consul services registered, by service name",
+		}, []string{"service"}),
+		TTLChecks: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "dockconsul_ttl_checks_total",
-			Help: "Number of active TTL checks",
-		}),
+			Help: "Number of active TTL checks, by service name",
+		}, []string{"service"}),
 		Events: prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "dockconsul_events_total",
 			Help: "Number of Docker events processed",
 		}),
-		Errors: prometheus.NewCounter(prometheus.CounterOpts{
+		Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "dockconsul_errors_total",
-			Help: "Number of errors encountered",
-		}),
-		SidecarsLaunched: prometheus.NewGauge(prometheus.GaugeOpts{
+			Help: "Number of errors encountered, by class",
+		}, []string{"class"}),
+		SidecarsLaunched: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "dockconsul_sidecars_launched",
-			Help: "Number of sidecar containers launched in last cycle",
-		}),
-		SidecarsDeleted: prometheus.NewGauge(prometheus.GaugeOpts{
+			Help: "Number of sidecar containers launched or recreated in last cycle, by outcome",
+		}, []string{"outcome"}),
+		SidecarsDeleted: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "dockconsul_sidecars_deleted",
-			Help: "Number of orphan sidecar containers deleted in last cycle",
+			Help: "Number of orphan sidecar containers deleted in last cycle, by outcome",
+		}, []string{"outcome"}),
+		Drift: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dockconsul_service_drift_total",
+			Help: "Number of managed services found to differ from their computed payload in Consul",
+		}, []string{"service"}),
+		ContainerStatus: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dockconsul_container_status",
+			Help: "Registration status of each service label of a container in the last cycle (1 for the current status)",
+		}, []string{"container", "service", "status"}),
+		Registrations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dockconsul_service_registrations_total",
+			Help: "Service registrations, by service name, Consul target, reason (new, changed, drift, cleanup, forced) and outcome",
+		}, []string{"service", "target", "reason", "outcome"}),
+		Deregistrations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dockconsul_service_deregistrations_total",
+			Help: "Service deregistrations, by service name, Consul target and outcome",
+		}, []string{"service", "target", "outcome"}),
+		Skips: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dockconsul_service_skips_total",
+			Help: "Services not registered in a cycle, by service name and reason",
+		}, []string{"service", "reason"}),
+		ConfigEntries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dockconsul_config_entry_operations_total",
+			Help: "Config entry writes and deletions, by kind, action (apply, delete) and outcome",
+		}, []string{"kind", "action", "outcome"}),
+		ReconcileDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dockconsul_reconcile_duration_seconds",
+			Help:    "Duration of reconciliation cycles, by outcome",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		}, []string{"outcome"}),
+		DockerInspectDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "dockconsul_docker_inspect_duration_seconds",
+			Help:    "Latency of Docker container inspect requests",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
 		}),
+		ConsulRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dockconsul_consul_request_duration_seconds",
+			Help:    "Latency of Consul HTTP API requests, by Consul target, method and endpoint",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+		}, []string{"target", "method", "endpoint"}),
+		SidecarUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dockconsul_sidecar_up",
+			Help: "Whether the sidecar of a service is healthy (1) or failing (0)",
+		}, []string{"service_id"}),
+		SidecarRestarts: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dockconsul_sidecar_restart_count",
+			Help: "Restart count of the sidecar container of a service",
+		}, []string{"service_id"}),
+		SidecarExitCode: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dockconsul_sidecar_last_exit_code",
+			Help: "Last exit code of the sidecar container of a service",
+		}, []string{"service_id"}),
 	}
 
 	prometheus.MustRegister(
@@ -56,11 +137,66 @@ func NewMetrics() *Metrics {
 		m.Errors,
 		m.SidecarsLaunched,
 		m.SidecarsDeleted,
+		m.Drift,
+		m.ContainerStatus,
+		m.Registrations,
+		m.Deregistrations,
+		m.Skips,
+		m.ConfigEntries,
+		m.ReconcileDuration,
+		m.DockerInspectDuration,
+		m.ConsulRequestDuration,
+		m.SidecarUp,
+		m.SidecarRestarts,
+		m.SidecarExitCode,
 	)
 	return m
 }
 
-func ServeMetrics(addr string) {
-	http.Handle("/metrics", promhttp.Handler())
-	go http.ListenAndServe(addr, nil)
+// ObserveConsul records the latency of a Consul API request. The endpoint is
+// reduced to a bounded set of values: IDs and KV keys are dropped.
+func (m *Metrics) ObserveConsul(target, method, path string, d time.Duration) {
+	m.ConsulRequestDuration.WithLabelValues(target, method, consulEndpoint(path)).Observe(d.Seconds())
+}
+
+func consulEndpoint(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) >= 2 && parts[1] == "kv" {
+		return "/v1/kv"
+	}
+	if len(parts) >= 4 && parts[1] == "config" {
+		parts = append(parts[:3], ":name")
+	}
+	if len(parts) >= 4 && parts[1] == "agent" && (parts[2] == "service" || parts[2] == "check") {
+		switch parts[3] {
+		case "register":
+			parts = parts[:4]
+		case "deregister", "pass", "warn", "fail", "update":
+			parts = append(parts[:4], ":id")
+		default:
+			parts = append(parts[:3], ":id")
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// ServeMetrics serves /metrics, /healthz, /readyz and the admin API on addr.
+// Listen errors are returned; the server then runs in the background.
+func ServeMetrics(addr string, health *Health, admin *AdminAPI) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", health.serveHealthz)
+	mux.HandleFunc("/readyz", health.serveReadyz)
+	mux.Handle("/admin/", admin)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Error("metrics server stopped", "error", err)
+		}
+	}()
+	return nil
 }
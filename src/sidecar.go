@@ -0,0 +1,600 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sidecarProxyUID is the user Envoy runs as; the transparent proxy rules
+// exclude its own traffic from redirection.
+const sidecarProxyUID = 1337
+
+// sidecarHashLabel holds the hash of the spec a sidecar was created from, so
+// spec changes can be detected on running sidecars.
+const sidecarHashLabel = "sidecar-hash"
+
+// sidecarInstanceLabel holds the label prefix of the registrator instance
+// owning a sidecar. It is only set for non-default prefixes.
+const sidecarInstanceLabel = "consul-registrator.instance"
+
+// SidecarSpec is the fully computed definition of a service's sidecar: the
+// optional redirect init container and the Envoy container.
+type SidecarSpec struct {
+	ServiceID string
+	Name      string
+	InitName  string
+	Init      map[string]interface{} // nil without transparent proxy
+	Config    map[string]interface{}
+	Hash      string
+}
+
+const (
+	defaultEnvoyAdminPort = 19000
+	defaultEnvoyReadyPort = 19100
+)
+
+// legacyExcludedInboundPort was excluded from inbound redirection by the
+// original bootstrap, as the usual Envoy Prometheus port. It stays excluded
+// whatever SIDECAR_PROMETHEUS_BIND_ADDR is set to.
+const legacyExcludedInboundPort = 20200
+
+// SidecarOverrides are the per-service sidecar settings read from the
+// consul.sidecar.<name> label:
+//
+//	sidecar {
+//	  provider               = "envoy"
+//	  image                  = "envoyproxy/envoy:v1.34"
+//	  admin_port             = 19001
+//	  ready_port             = 19101
+//	  log_level              = "debug"
+//	  extra_args             = ["-envoy-version", "1.34.1"]
+//	  envoy_args             = ["--concurrency", "2"]
+//	  env                    = { FOO = "bar" }
+//	  exclude_inbound_ports  = [9000]
+//	  exclude_outbound_ports = [5432]
+//	  exclude_outbound_cidrs = ["10.0.0.0/8"]
+//	  resources { memory = "512m"  cpus = "0.5"  pids_limit = 128 }
+//	  bootstrap { envoy_stats_flush_interval = "10s" }
+//	}
+type SidecarOverrides struct {
+	Provider             string // envoy, consul-proxy or template
+	Image                string
+	AdminPort            int64
+	ReadyPort            int64
+	LogLevel             string
+	ExtraArgs            []string // extra `consul connect envoy` flags
+	EnvoyArgs            []string // passed to envoy after "--"
+	Env                  map[string]string
+	ExcludeInboundPorts  []int64
+	ExcludeOutboundPorts []int64
+	ExcludeOutboundCIDRs []string
+	Memory               string
+	CPUs                 string
+	PidsLimit            int64
+	// Bootstrap entries are merged into the sidecar_service proxy config,
+	// where Consul reads the Envoy bootstrap options.
+	Bootstrap map[string]any
+}
+
+// ParseSidecarOverrides decodes a consul.sidecar.<name> label value. It
+// returns nil when the label only requests a sidecar.
+func ParseSidecarOverrides(input string) (*SidecarOverrides, error) {
+	m, err := ParseSidecarHCL(input)
+	if err != nil || m == nil {
+		return nil, err
+	}
+
+	ov := &SidecarOverrides{}
+	var errs []error
+
+	s := &configSection{name: "sidecar", values: m, used: map[string]bool{}}
+	s.str("provider", &ov.Provider)
+	s.str("image", &ov.Image)
+	s.integer("admin_port", &ov.AdminPort)
+	s.integer("ready_port", &ov.ReadyPort)
+	s.str("log_level", &ov.LogLevel)
+	s.list("extra_args", &ov.ExtraArgs)
+	s.list("envoy_args", &ov.EnvoyArgs)
+	s.stringMap("env", &ov.Env)
+	s.intList("exclude_inbound_ports", &ov.ExcludeInboundPorts)
+	s.intList("exclude_outbound_ports", &ov.ExcludeOutboundPorts)
+	s.list("exclude_outbound_cidrs", &ov.ExcludeOutboundCIDRs)
+	if raw, ok := s.lookup("resources"); ok {
+		values, _ := raw.(map[string]any)
+		r := &configSection{name: "sidecar.resources", values: values, used: map[string]bool{}}
+		r.str("memory", &ov.Memory)
+		r.str("cpus", &ov.CPUs)
+		r.integer("pids_limit", &ov.PidsLimit)
+		errs = append(errs, r.finish()...)
+	}
+	if raw, ok := s.lookup("bootstrap"); ok {
+		ov.Bootstrap, _ = raw.(map[string]any)
+	}
+	errs = append(errs, s.finish()...)
+	errs = append(errs, ov.validate()...)
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return ov, nil
+}
+
+func (ov *SidecarOverrides) validate() []error {
+	var errs []error
+	for _, p := range []struct {
+		name string
+		port int64
+	}{{"admin_port", ov.AdminPort}, {"ready_port", ov.ReadyPort}} {
+		if p.port != 0 && !isValidPort(int(p.port)) {
+			errs = append(errs, fmt.Errorf("sidecar.%s: invalid port %d", p.name, p.port))
+		}
+	}
+	if ov.AdminPort != 0 && ov.AdminPort == ov.ReadyPort {
+		errs = append(errs, fmt.Errorf("sidecar.admin_port and sidecar.ready_port must differ"))
+	}
+	for _, p := range append(append([]int64{}, ov.ExcludeInboundPorts...), ov.ExcludeOutboundPorts...) {
+		if !isValidPort(int(p)) {
+			errs = append(errs, fmt.Errorf("sidecar: invalid excluded port %d", p))
+		}
+	}
+	for _, c := range ov.ExcludeOutboundCIDRs {
+		if _, _, err := net.ParseCIDR(c); err != nil {
+			errs = append(errs, fmt.Errorf("sidecar.exclude_outbound_cidrs: %w", err))
+		}
+	}
+	if _, err := parseByteSize(ov.Memory); err != nil {
+		errs = append(errs, fmt.Errorf("sidecar.resources.memory: %w", err))
+	}
+	if _, err := parseNanoCPUs(ov.CPUs); err != nil {
+		errs = append(errs, fmt.Errorf("sidecar.resources.cpus: %w", err))
+	}
+	return errs
+}
+
+// envoyAdminPort and envoyReadyPort are safe to call on a nil receiver.
+func (ov *SidecarOverrides) envoyAdminPort() int {
+	if ov == nil || ov.AdminPort == 0 {
+		return defaultEnvoyAdminPort
+	}
+	return int(ov.AdminPort)
+}
+
+func (ov *SidecarOverrides) envoyReadyPort() int {
+	if ov == nil || ov.ReadyPort == 0 {
+		return defaultEnvoyReadyPort
+	}
+	return int(ov.ReadyPort)
+}
+
+// applyBootstrapOverrides merges the Envoy bootstrap options into the
+// sidecar_service proxy config without replacing keys set in the service HCL.
+func applyBootstrapOverrides(svc map[string]any, ov *SidecarOverrides) {
+	if ov == nil || len(ov.Bootstrap) == 0 {
+		return
+	}
+	connect, _ := svc["connect"].(map[string]any)
+	if connect == nil {
+		return
+	}
+	sidecar, _ := connect["sidecar_service"].(map[string]any)
+	if sidecar == nil {
+		return
+	}
+	proxy, _ := sidecar["proxy"].(map[string]any)
+	if proxy == nil {
+		proxy = map[string]any{}
+		sidecar["proxy"] = proxy
+	}
+	cfg, _ := proxy["config"].(map[string]any)
+	if cfg == nil {
+		cfg = map[string]any{}
+		proxy["config"] = cfg
+	}
+	for k, v := range ov.Bootstrap {
+		if _, ok := cfg[k]; !ok {
+			cfg[k] = v
+		}
+	}
+}
+
+// applyEnvoyReadyGate keeps a service with a sidecar from being passing
+// before the proxy is ready: a check on the proxy's ready endpoint, critical
+// until it first passes, is added to the service itself. Checks declared in
+// the label keep the status they were given. Proxies without a ready
+// endpoint (readyPort 0) are not gated.
+func applyEnvoyReadyGate(svc map[string]any, serviceName string, readyPort int) {
+	host := serviceName
+	if addr, ok := svc["address"].(string); ok && addr != "" {
+		host = addr
+	} else if addr, ok := svc["Address"].(string); ok && addr != "" {
+		host = addr
+	}
+
+	checks := []any{}
+	if raw, ok := svc["checks"].([]any); ok {
+		checks = raw
+	} else if one, ok := svc["check"].(map[string]any); ok {
+		checks = []any{one}
+	}
+
+	readyURL := fmt.Sprintf("http://%s:%d/ready", host, readyPort)
+	hasReady := readyPort == 0
+	for _, c := range checks {
+		m, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		normalizeCheckKeys(m)
+		if v, _ := m["HTTP"].(string); v == readyURL {
+			hasReady = true
+		}
+	}
+
+	if !hasReady {
+		checks = append(checks, map[string]any{
+			"Name":     "Envoy Ready " + serviceName,
+			"HTTP":     readyURL,
+			"Interval": "10s",
+			"Timeout":  "2s",
+			"Status":   "critical",
+		})
+	}
+
+	delete(svc, "check")
+	svc["checks"] = checks
+}
+
+// SidecarRequest carries what a SidecarProvider needs to build the sidecar of
+// one service.
+type SidecarRequest struct {
+	ParentID      string
+	Name          string
+	ServiceID     string
+	Scope         ConsulScope
+	Target        ConsulTarget
+	Cfg           *Config
+	NeedsNetAdmin bool
+	Overrides     *SidecarOverrides // may be nil
+}
+
+// scopeArgs are the consul CLI flags selecting the service's namespace and
+// partition.
+func (r SidecarRequest) scopeArgs() []string {
+	var args []string
+	if r.Scope.Namespace != "" {
+		args = append(args, "-namespace", r.Scope.Namespace)
+	}
+	if r.Scope.Partition != "" {
+		args = append(args, "-partition", r.Scope.Partition)
+	}
+	return args
+}
+
+// grpcAddr and httpAddr are the agent addresses used by the sidecar: the
+// target's when set, else the global ones.
+func (r SidecarRequest) grpcAddr() string {
+	if r.Target.SidecarGrpcAddr != "" {
+		return normalizeAddr(r.Target.SidecarGrpcAddr)
+	}
+	return normalizeAddr(r.Cfg.SidecarGrpcAddr)
+}
+
+func (r SidecarRequest) httpAddr() string {
+	if r.Target.SidecarHttpAddr != "" {
+		return strings.TrimSpace(r.Target.SidecarHttpAddr)
+	}
+	return strings.TrimSpace(r.Cfg.SidecarHttpAddr)
+}
+
+func (r SidecarRequest) image() string {
+	if r.Overrides != nil && r.Overrides.Image != "" {
+		return r.Overrides.Image
+	}
+	return r.Cfg.SidecarImage
+}
+
+// hardening is the global profile with the per-service resource overrides.
+func (r SidecarRequest) hardening() SidecarHardening {
+	h := r.Cfg.SidecarHardening
+	if ov := r.Overrides; ov != nil {
+		if ov.Memory != "" {
+			h.Memory = ov.Memory
+		}
+		if ov.CPUs != "" {
+			h.CPUs = ov.CPUs
+		}
+		if ov.PidsLimit != 0 {
+			h.PidsLimit = ov.PidsLimit
+		}
+	}
+	return h
+}
+
+func (r SidecarRequest) env() []string {
+	env := []string{
+		"SERVICE_NAME=" + r.Name,
+		"CONSUL_HTTP_ADDR=" + r.httpAddr(),
+		"CONSUL_GRPC_ADDR=" + r.grpcAddr(),
+	}
+	if r.Overrides == nil {
+		return env
+	}
+	keys := make([]string, 0, len(r.Overrides.Env))
+	for k := range r.Overrides.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, k+"="+r.Overrides.Env[k])
+	}
+	return env
+}
+
+func newSidecarSpec(serviceID string) *SidecarSpec {
+	return &SidecarSpec{
+		ServiceID: serviceID,
+		Name:      "consul_sidecar-" + strings.ReplaceAll(serviceID, ":", "_"),
+		InitName:  "consul_sidecar_init-" + strings.ReplaceAll(serviceID, ":", "_"),
+	}
+}
+
+// sidecarHostConfig is the HostConfig shared by all sidecar containers.
+func sidecarHostConfig(parentID, restart string, h SidecarHardening, requiredCaps []string) (map[string]interface{}, error) {
+	hostConfig := map[string]interface{}{
+		"NetworkMode":   "container:" + parentID,
+		"RestartPolicy": map[string]string{"Name": restart},
+	}
+	if err := applySidecarHardening(hostConfig, h, requiredCaps); err != nil {
+		return nil, err
+	}
+	return hostConfig, nil
+}
+
+// redirectInit builds the init container running `consul connect
+// redirect-traffic` for a proxy listening on readyPort (0 if none).
+func redirectInit(req SidecarRequest, readyPort int) (map[string]interface{}, error) {
+	hostConfig, err := sidecarHostConfig(req.ParentID, "no", req.hardening(), []string{"NET_ADMIN", "NET_RAW"})
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := []string{
+		"connect", "redirect-traffic",
+		"-proxy-id", req.ServiceID + "-sidecar-proxy",
+		"-proxy-uid", strconv.Itoa(sidecarProxyUID),
+	}
+	cmd = append(cmd, req.scopeArgs()...)
+	if readyPort != 0 {
+		cmd = append(cmd, "-exclude-inbound-port", strconv.Itoa(readyPort))
+	}
+	cmd = append(cmd, "-exclude-inbound-port", strconv.Itoa(legacyExcludedInboundPort))
+	if req.Cfg.SidecarPrometheusBindAddr != "" {
+		if _, port, err := parseHostPort(req.Cfg.SidecarPrometheusBindAddr); err == nil {
+			cmd = append(cmd, "-exclude-inbound-port", strconv.Itoa(port))
+		}
+	}
+	if ov := req.Overrides; ov != nil {
+		for _, p := range ov.ExcludeInboundPorts {
+			cmd = append(cmd, "-exclude-inbound-port", strconv.FormatInt(p, 10))
+		}
+		for _, p := range ov.ExcludeOutboundPorts {
+			cmd = append(cmd, "-exclude-outbound-port", strconv.FormatInt(p, 10))
+		}
+		for _, c := range ov.ExcludeOutboundCIDRs {
+			cmd = append(cmd, "-exclude-outbound-cidr", c)
+		}
+	}
+
+	return map[string]interface{}{
+		"Image":      req.image(),
+		"Entrypoint": []string{sidecarConsulBinary(req.Cfg)},
+		"Cmd":        cmd,
+		"User":       "0",
+		"Env":        req.env(),
+		"HostConfig": hostConfig,
+		"Labels": map[string]string{
+			"consul-registrator": "sidecar-init",
+			"service-id":         req.ServiceID,
+		},
+	}, nil
+}
+
+// finalizeSidecarSpec sets the registrator labels on the main container and
+// stamps the spec hash. labelPrefix identifies the owning instance.
+func finalizeSidecarSpec(spec *SidecarSpec, labelPrefix string) (*SidecarSpec, error) {
+	labels, _ := spec.Config["Labels"].(map[string]string)
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels["consul-registrator"] = "sidecar"
+	labels["service-id"] = spec.ServiceID
+	if labelPrefix != defaultLabelPrefix {
+		labels[sidecarInstanceLabel] = labelPrefix
+	}
+	delete(labels, sidecarHashLabel)
+	spec.Config["Labels"] = labels
+
+	b, err := json.Marshal([]interface{}{spec.Init, spec.Config})
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	spec.Hash = hex.EncodeToString(sum[:])[:16]
+	labels[sidecarHashLabel] = spec.Hash
+
+	return spec, nil
+}
+
+// LaunchSidecar starts a sidecar in the network namespace of its parent
+// container. When the spec has an init container, it runs to completion
+// first.
+func (d *DockerClient) LaunchSidecar(ctx context.Context, spec *SidecarSpec) (err error) {
+	ctx, span := tracer.Start(ctx, "sidecar.launch", trace.WithAttributes(
+		attribute.String("service.id", spec.ServiceID),
+		attribute.String("sidecar.name", spec.Name),
+	))
+	defer func() { endSpan(span, err) }()
+
+	if spec.Init != nil {
+		if err := d.runSidecarInit(ctx, spec); err != nil {
+			return fmt.Errorf("sidecar init: %w", err)
+		}
+	}
+
+	slog.InfoContext(ctx, "creating sidecar container", "sidecar", spec.Name, "service_id", spec.ServiceID, "hash", spec.Hash, "action", "sidecar_create")
+	slog.DebugContext(ctx, "sidecar spec", "service_id", spec.ServiceID, "init", redactPayload(spec.Init), "config", redactPayload(spec.Config))
+	id, status, err := d.createContainer(ctx, spec.Name, spec.Config)
+	if status == http.StatusConflict {
+		return d.StartContainer(ctx, spec.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	return d.StartContainer(ctx, id)
+}
+
+// RecreateSidecar replaces an existing sidecar container with one built from
+// spec.
+func (d *DockerClient) RecreateSidecar(ctx context.Context, oldID string, spec *SidecarSpec) (err error) {
+	ctx, span := tracer.Start(ctx, "sidecar.recreate", trace.WithAttributes(
+		attribute.String("service.id", spec.ServiceID),
+		attribute.String("sidecar.old_id", oldID),
+	))
+	defer func() { endSpan(span, err) }()
+
+	if err := d.RemoveContainer(ctx, oldID); err != nil {
+		return err
+	}
+	return d.LaunchSidecar(ctx, spec)
+}
+
+// runSidecarInit runs `consul connect redirect-traffic` as root in a
+// short-lived container sharing the parent's network namespace, waits for it
+// and removes it.
+func (d *DockerClient) runSidecarInit(ctx context.Context, spec *SidecarSpec) error {
+	id, status, err := d.createContainer(ctx, spec.InitName, spec.Init)
+	if status == http.StatusConflict {
+		// Left over from an interrupted launch.
+		if err := d.RemoveContainer(ctx, spec.InitName); err != nil {
+			return err
+		}
+		id, _, err = d.createContainer(ctx, spec.InitName, spec.Init)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.RemoveContainer(context.Background(), id) }()
+
+	if err := d.StartContainer(ctx, id); err != nil {
+		return err
+	}
+	code, err := d.WaitContainer(ctx, id)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("redirect-traffic exited with code %d", code)
+	}
+	return nil
+}
+
+func sidecarConsulBinary(cfg *Config) string {
+	if cfg.SidecarConsulBinary != "" {
+		return cfg.SidecarConsulBinary
+	}
+	return "consul"
+}
+
+// applySidecarHardening applies the hardening profile to a sidecar
+// HostConfig. requiredCaps are added back on top of the profile's CapAdd.
+func applySidecarHardening(hostConfig map[string]interface{}, h SidecarHardening, requiredCaps []string) error {
+	if len(h.CapDrop) > 0 {
+		hostConfig["CapDrop"] = h.CapDrop
+	}
+
+	capAdd := append([]string{}, h.CapAdd...)
+	for _, c := range requiredCaps {
+		if !containsFold(capAdd, c) {
+			capAdd = append(capAdd, c)
+		}
+	}
+	hostConfig["CapAdd"] = capAdd
+
+	if h.ReadonlyRootfs {
+		hostConfig["ReadonlyRootfs"] = true
+	}
+	if len(h.Tmpfs) > 0 {
+		tmpfs := map[string]string{}
+		for _, t := range h.Tmpfs {
+			path, opts, _ := strings.Cut(t, ":")
+			tmpfs[path] = opts
+		}
+		hostConfig["Tmpfs"] = tmpfs
+	}
+
+	if mem, err := parseByteSize(h.Memory); err != nil {
+		return err
+	} else if mem > 0 {
+		hostConfig["Memory"] = mem
+	}
+	if cpus, err := parseNanoCPUs(h.CPUs); err != nil {
+		return err
+	} else if cpus > 0 {
+		hostConfig["NanoCpus"] = cpus
+	}
+	if h.PidsLimit > 0 {
+		hostConfig["PidsLimit"] = h.PidsLimit
+	}
+
+	var secOpt []string
+	if h.NoNewPrivileges {
+		secOpt = append(secOpt, "no-new-privileges:true")
+	}
+	switch h.SeccompProfile {
+	case "":
+	case "unconfined":
+		secOpt = append(secOpt, "seccomp=unconfined")
+	default:
+		// The Engine API expects the profile content, not a path.
+		b, err := os.ReadFile(h.SeccompProfile)
+		if err != nil {
+			return fmt.Errorf("read seccomp profile: %w", err)
+		}
+		secOpt = append(secOpt, "seccomp="+string(b))
+	}
+	if h.AppArmorProfile != "" {
+		secOpt = append(secOpt, "apparmor="+h.AppArmorProfile)
+	}
+	if len(secOpt) > 0 {
+		hostConfig["SecurityOpt"] = secOpt
+	}
+
+	if h.UsernsMode != "" {
+		hostConfig["UsernsMode"] = h.UsernsMode
+	}
+	return nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, it := range list {
+		if strings.EqualFold(strings.TrimPrefix(strings.ToUpper(it), "CAP_"), s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// sidecarLogTailLines is how many log lines of a failing sidecar are kept in
+// the log and in the Consul check output.
+const sidecarLogTailLines = 20
+
+// sidecarRestartWindow is how long a sidecar that restarted is considered
+// failing after it last started: long enough to span several cycles of a
+// crash loop, and to outlive the re-registration that drops its check.
+const sidecarRestartWindow = 5 * time.Minute
+
+// sidecarNote is the failure last reported for a sidecar: note is "" while
+// it is healthy, and updated the time the Consul check was last written.
+type sidecarNote struct {
+	note    string
+	updated time.Time
+}
+
+func sidecarCheckID(serviceID string) string {
+	return "sidecar-health:" + serviceID
+}
+
+// sidecarFailure describes why a sidecar is failing at now, or returns ""
+// when it is healthy.
+func sidecarFailure(si *DockerInspect, now time.Time) string {
+	st := si.State
+	var reason string
+	switch {
+	case st.Restarting:
+		reason = "restarting"
+	case st.Status == "dead":
+		reason = "dead"
+	case !st.Running && st.ExitCode != 0:
+		reason = "exited"
+	case st.Running && si.RestartCount > 0 && now.Sub(st.StartedAt) < sidecarRestartWindow:
+		reason = "restarted at " + st.StartedAt.UTC().Format(time.RFC3339)
+	default:
+		return ""
+	}
+
+	parts := []string{reason}
+	if st.ExitCode != 0 {
+		parts = append(parts, fmt.Sprintf("exit code %d", st.ExitCode))
+	}
+	if st.OOMKilled {
+		parts = append(parts, "OOM killed")
+	}
+	if si.RestartCount > 0 {
+		parts = append(parts, fmt.Sprintf("%d restarts", si.RestartCount))
+	}
+	if st.Error != "" {
+		parts = append(parts, st.Error)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// monitorSidecars updates the sidecar health metrics and, for each failing
+// sidecar, keeps a critical check on its service in Consul whose output
+// holds the reason and the last log lines. The check is written when the
+// reason changes, and refreshed every re-register interval before its TTL
+// runs out; it is removed once the sidecar recovers. The failure reasons
+// are returned by service ID.
+func (a *Agent) monitorSidecars(ctx context.Context, sidecars map[string]*DockerInspect, found map[string]bool) map[string]string {
+	if a.sidecarFailing == nil {
+		a.sidecarFailing = map[string]sidecarNote{}
+	}
+	failures := map[string]string{}
+	now := time.Now()
+
+	for sid, si := range sidecars {
+		if !found[sid] {
+			continue
+		}
+
+		a.metrics.SidecarRestarts.WithLabelValues(sid).Set(float64(si.RestartCount))
+		a.metrics.SidecarExitCode.WithLabelValues(sid).Set(float64(si.State.ExitCode))
+
+		reason := sidecarFailure(si, now)
+		prev := a.sidecarFailing[sid]
+		wasFailing := prev.note != ""
+		if reason == "" {
+			a.sidecarFailing[sid] = sidecarNote{}
+			a.metrics.SidecarUp.WithLabelValues(sid).Set(1)
+			if wasFailing {
+				slog.InfoContext(ctx, "sidecar recovered", "sidecar", si.ID, "service_id", sid)
+			}
+			if st := a.serviceState(sid); st != nil && st.SidecarChecks[sid] {
+				a.clearSidecarCheck(ctx, st, sid)
+			}
+			continue
+		}
+		a.metrics.SidecarUp.WithLabelValues(sid).Set(0)
+		failures[sid] = reason
+
+		note := fmt.Sprintf("sidecar %s is failing: %s", strings.TrimPrefix(si.Name, "/"), reason)
+		st := a.serviceState(sid)
+		if st != nil && st.SidecarChecks[sid] && prev.note == note && now.Sub(prev.updated) < a.reregisterInterval() {
+			continue
+		}
+
+		logs, err := a.docker.Logs(ctx, si.ID, sidecarLogTailLines)
+		if err != nil {
+			a.metrics.Errors.WithLabelValues(errClassDocker).Inc()
+			logs = fmt.Sprintf("(logs unavailable: %v)", err)
+		}
+		logs = strings.TrimRight(logs, "\n")
+
+		if prev.note != note {
+			slog.ErrorContext(ctx, "sidecar failing", "sidecar", si.ID, "service_id", sid, "reason", reason, "logs", logs)
+		}
+
+		// On error the check is written again next cycle.
+		a.sidecarFailing[sid] = sidecarNote{note: note}
+		if err := a.markSidecarFailing(ctx, sid, note, logs); err != nil {
+			a.metrics.Errors.WithLabelValues(errClassConsul).Inc()
+			slog.ErrorContext(ctx, "failed to mark service critical", "service_id", sid, "error", err)
+			continue
+		}
+		a.sidecarFailing[sid] = sidecarNote{note: note, updated: now}
+	}
+
+	// Drop the checks and metrics of services that no longer have a sidecar.
+	for sid := range a.sidecarFailing {
+		if _, ok := sidecars[sid]; ok && found[sid] {
+			continue
+		}
+		delete(a.sidecarFailing, sid)
+		a.metrics.SidecarUp.DeleteLabelValues(sid)
+		a.metrics.SidecarRestarts.DeleteLabelValues(sid)
+		a.metrics.SidecarExitCode.DeleteLabelValues(sid)
+	}
+	for _, st := range a.states {
+		for sid := range st.SidecarChecks {
+			if _, ok := sidecars[sid]; !ok && found[sid] {
+				a.clearSidecarCheck(ctx, st, sid)
+			}
+		}
+	}
+	return failures
+}
+
+// markSidecarFailing registers the critical sidecar check of a service if
+// needed and refreshes its output. Re-registering the service drops the
+// check (replace-existing-checks), so the agent forgets it on registration
+// and it is registered again here, later in the same cycle.
+func (a *Agent) markSidecarFailing(ctx context.Context, serviceID, note, logs string) error {
+	st := a.serviceState(serviceID)
+	if st == nil {
+		return fmt.Errorf("service %s is not registered", serviceID)
+	}
+	checkID := sidecarCheckID(serviceID)
+	scope := st.Scopes[serviceID]
+	consul, err := a.client(scope)
+	if err != nil {
+		return err
+	}
+	if !st.SidecarChecks[serviceID] {
+		err := consul.RegisterCheck(ctx, map[string]any{
+			"ID":        checkID,
+			"Name":      "Sidecar health",
+			"ServiceID": serviceID,
+			"Notes":     "Set by consul-registrator while the sidecar container is failing",
+			"TTL":       a.sidecarCheckTTL().String(),
+			"Status":    "critical",
+		}, scope.Namespace, scope.Partition)
+		if err != nil {
+			return err
+		}
+		st.SidecarChecks[serviceID] = true
+	}
+
+	output := note
+	if logs != "" {
+		output += "\n\nlast log lines:\n" + logs
+	}
+	return consul.UpdateCheck(ctx, checkID, scope.Namespace, scope.Partition, "critical", output)
+}
+
+// sidecarCheckTTL outlasts the refresh of the sidecar check by two cycles,
+// so the check is only left to expire by a registrator that stopped.
+func (a *Agent) sidecarCheckTTL() time.Duration {
+	return a.reregisterInterval() + 2*a.cfg.Interval
+}
+
+func (a *Agent) clearSidecarCheck(ctx context.Context, st *State, serviceID string) {
+	scope := st.Scopes[serviceID]
+	consul, err := a.client(scope)
+	if err == nil {
+		err = consul.DeregisterCheck(ctx, sidecarCheckID(serviceID), scope.Namespace, scope.Partition)
+	}
+	if err != nil {
+		a.metrics.Errors.WithLabelValues(errClassConsul).Inc()
+		slog.ErrorContext(ctx, "failed to remove sidecar check", "service_id", serviceID, "error", err)
+		return
+	}
+	delete(st.SidecarChecks, serviceID)
+}
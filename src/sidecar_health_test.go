@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSidecarFailure(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	inspect := func(restarts int, status string, set func(si *DockerInspect)) *DockerInspect {
+		si := &DockerInspect{RestartCount: restarts}
+		si.State.Status = status
+		si.State.Running = status == "running"
+		si.State.Restarting = status == "restarting"
+		if set != nil {
+			set(si)
+		}
+		return si
+	}
+
+	tests := []struct {
+		name string
+		si   *DockerInspect
+		want string
+	}{
+		{
+			name: "running",
+			si:   inspect(0, "running", func(si *DockerInspect) { si.State.StartedAt = now.Add(-time.Second) }),
+		},
+		{
+			name: "restarted long ago",
+			si:   inspect(3, "running", func(si *DockerInspect) { si.State.StartedAt = now.Add(-time.Hour) }),
+		},
+		{
+			name: "restarted recently",
+			si:   inspect(3, "running", func(si *DockerInspect) { si.State.StartedAt = now.Add(-90 * time.Second) }),
+			want: "restarted at 2025-01-01T11:58:30Z, 3 restarts",
+		},
+		{
+			name: "restarting",
+			si:   inspect(4, "restarting", func(si *DockerInspect) { si.State.ExitCode = 1 }),
+			want: "restarting, exit code 1, 4 restarts",
+		},
+		{
+			name: "exited",
+			si:   inspect(0, "exited", func(si *DockerInspect) { si.State.ExitCode = 137; si.State.OOMKilled = true }),
+			want: "exited, exit code 137, OOM killed",
+		},
+		{
+			name: "stopped cleanly",
+			si:   inspect(0, "exited", nil),
+		},
+		{
+			name: "dead",
+			si:   inspect(0, "dead", func(si *DockerInspect) { si.State.Error = "driver failed" }),
+			want: "dead, driver failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sidecarFailure(tt.si, now); got != tt.want {
+				t.Errorf("sidecarFailure() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMonitorSidecarsWritesCheckOnChange(t *testing.T) {
+	var logs, registers, updates atomic.Int32
+	var ttl atomic.Value
+
+	dmux := http.NewServeMux()
+	dmux.HandleFunc("/containers/side1/logs", func(w http.ResponseWriter, r *http.Request) {
+		logs.Add(1)
+		_, _ = w.Write([]byte("boom\n"))
+	})
+	sock := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsrv := &httptest.Server{Listener: l, Config: &http.Server{Handler: dmux}}
+	dsrv.Start()
+	defer dsrv.Close()
+
+	csrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/agent/check/register":
+			var def map[string]any
+			_ = json.NewDecoder(r.Body).Decode(&def)
+			ttl.Store(def["TTL"])
+			registers.Add(1)
+		case strings.HasPrefix(r.URL.Path, "/v1/agent/check/update/"):
+			updates.Add(1)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer csrv.Close()
+
+	cfg := defaultConfig()
+	cfg.Interval = 10 * time.Second
+	cfg.ReRegisterInterval = 5 * time.Minute
+	st := newState()
+	st.Services["web:1"] = true
+	a := &Agent{
+		docker:  NewDockerClient(sock, 5*time.Second),
+		targets: map[string]*ConsulClient{defaultTarget: NewConsulClient(csrv.URL, "", 5*time.Second, false)},
+		metrics: testMetrics(),
+		states:  map[string]*State{defaultTarget: st},
+		cfg:     cfg,
+	}
+
+	si := &DockerInspect{ID: "side1", Name: "/web-1-sidecar"}
+	si.State.Status = "exited"
+	si.State.ExitCode = 1
+	sidecars := map[string]*DockerInspect{"web:1": si}
+	found := map[string]bool{"web:1": true}
+	ctx := context.Background()
+
+	a.monitorSidecars(ctx, sidecars, found)
+	a.monitorSidecars(ctx, sidecars, found)
+	if logs.Load() != 1 || registers.Load() != 1 || updates.Load() != 1 {
+		t.Fatalf("unchanged failure: %d log fetches, %d registers, %d updates, want 1 each", logs.Load(), registers.Load(), updates.Load())
+	}
+	if got := ttl.Load(); got != "5m20s" {
+		t.Errorf("TTL = %v, want 5m20s", got)
+	}
+
+	si.State.ExitCode = 2
+	a.monitorSidecars(ctx, sidecars, found)
+	if logs.Load() != 2 || registers.Load() != 1 || updates.Load() != 2 {
+		t.Fatalf("changed failure: %d log fetches, %d registers, %d updates, want 2, 1, 2", logs.Load(), registers.Load(), updates.Load())
+	}
+
+	// Past the re-register interval the check is refreshed before its TTL
+	// runs out.
+	n := a.sidecarFailing["web:1"]
+	n.updated = n.updated.Add(-cfg.ReRegisterInterval)
+	a.sidecarFailing["web:1"] = n
+	a.monitorSidecars(ctx, sidecars, found)
+	if updates.Load() != 3 {
+		t.Errorf("after the re-register interval: %d updates, want 3", updates.Load())
+	}
+
+	// Re-registering the service drops the check, which is added again.
+	delete(st.SidecarChecks, "web:1")
+	a.monitorSidecars(ctx, sidecars, found)
+	if registers.Load() != 2 || updates.Load() != 4 {
+		t.Errorf("after re-registration: %d registers, %d updates, want 2, 4", registers.Load(), updates.Load())
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// SidecarProvider builds the containers of a service's sidecar proxy.
+type SidecarProvider interface {
+	// Kind names the provider, as used in config, labels and tags.
+	Kind() string
+	// ReadyPort is the port of the proxy's HTTP /ready endpoint, or 0 when
+	// the proxy has none.
+	ReadyPort(ov *SidecarOverrides) int
+	Build(req SidecarRequest) (*SidecarSpec, error)
+}
+
+const (
+	sidecarProviderEnvoy       = "envoy"
+	sidecarProviderConsulProxy = "consul-proxy"
+	sidecarProviderTemplate    = "template"
+)
+
+// NewSidecarProviders returns the available providers by kind. The template
+// provider is only available when a template file is configured.
+func NewSidecarProviders(cfg *Config) (map[string]SidecarProvider, error) {
+	providers := map[string]SidecarProvider{
+		sidecarProviderEnvoy:       envoySidecarProvider{},
+		sidecarProviderConsulProxy: consulProxySidecarProvider{},
+	}
+	if cfg.SidecarTemplateFile != "" {
+		t, err := loadTemplateSidecarProvider(cfg.SidecarTemplateFile)
+		if err != nil {
+			return nil, fmt.Errorf("sidecar template %s: %w", cfg.SidecarTemplateFile, err)
+		}
+		providers[sidecarProviderTemplate] = t
+	}
+	return providers, nil
+}
+
+// envoySidecarProvider runs `consul connect envoy`.
+type envoySidecarProvider struct{}
+
+func (envoySidecarProvider) Kind() string { return sidecarProviderEnvoy }
+
+func (envoySidecarProvider) ReadyPort(ov *SidecarOverrides) int { return ov.envoyReadyPort() }
+
+func (p envoySidecarProvider) Build(req SidecarRequest) (*SidecarSpec, error) {
+	ov := req.Overrides
+	spec := newSidecarSpec(req.ServiceID)
+
+	if req.NeedsNetAdmin {
+		init, err := redirectInit(req, p.ReadyPort(ov))
+		if err != nil {
+			return nil, err
+		}
+		spec.Init = init
+	}
+
+	cmd := []string{
+		"connect", "envoy",
+		"-sidecar-for", req.ServiceID,
+		"-admin-bind", "127.0.0.1:" + strconv.Itoa(ov.envoyAdminPort()),
+		"-envoy-ready-bind-address", "0.0.0.0",
+		"-envoy-ready-bind-port", strconv.Itoa(p.ReadyPort(ov)),
+		"-grpc-addr", req.grpcAddr(),
+		"-http-addr", req.httpAddr(),
+	}
+	cmd = append(cmd, req.scopeArgs()...)
+	if req.Cfg.SidecarGrpcTLS && req.Cfg.SidecarCAPath != "" {
+		cmd = append(cmd, "-grpc-ca-file", req.Cfg.SidecarCAPath)
+	}
+	if ov != nil {
+		cmd = append(cmd, ov.ExtraArgs...)
+		var envoyArgs []string
+		if ov.LogLevel != "" {
+			envoyArgs = append(envoyArgs, "--log-level", ov.LogLevel)
+		}
+		envoyArgs = append(envoyArgs, ov.EnvoyArgs...)
+		if len(envoyArgs) > 0 {
+			cmd = append(append(cmd, "--"), envoyArgs...)
+		}
+	}
+
+	hostConfig, err := sidecarHostConfig(req.ParentID, "unless-stopped", req.hardening(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	spec.Config = map[string]interface{}{
+		"Image":      req.image(),
+		"Entrypoint": []string{sidecarConsulBinary(req.Cfg)},
+		"Cmd":        cmd,
+		"User":       strconv.Itoa(sidecarProxyUID),
+		"Env":        req.env(),
+		"HostConfig": hostConfig,
+	}
+	return finalizeSidecarSpec(spec, req.Cfg.LabelPrefix)
+}
+
+// consulProxySidecarProvider runs Consul's built-in proxy (`consul connect
+// proxy`). It talks to the agent over HTTP only, has no ready endpoint and
+// does not support transparent proxy.
+type consulProxySidecarProvider struct{}
+
+func (consulProxySidecarProvider) Kind() string { return sidecarProviderConsulProxy }
+
+func (consulProxySidecarProvider) ReadyPort(*SidecarOverrides) int { return 0 }
+
+func (consulProxySidecarProvider) Build(req SidecarRequest) (*SidecarSpec, error) {
+	if req.NeedsNetAdmin {
+		return nil, fmt.Errorf("the %s sidecar provider does not support transparent proxy", sidecarProviderConsulProxy)
+	}
+
+	spec := newSidecarSpec(req.ServiceID)
+
+	httpAddr := req.httpAddr()
+	cmd := []string{
+		"connect", "proxy",
+		"-sidecar-for", req.ServiceID,
+		"-http-addr", httpAddr,
+	}
+	cmd = append(cmd, req.scopeArgs()...)
+	if strings.HasPrefix(httpAddr, "https://") && req.Cfg.SidecarCAPath != "" {
+		cmd = append(cmd, "-ca-file", req.Cfg.SidecarCAPath)
+	}
+	if req.Overrides != nil {
+		cmd = append(cmd, req.Overrides.ExtraArgs...)
+	}
+
+	hostConfig, err := sidecarHostConfig(req.ParentID, "unless-stopped", req.hardening(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	spec.Config = map[string]interface{}{
+		"Image":      req.image(),
+		"Entrypoint": []string{sidecarConsulBinary(req.Cfg)},
+		"Cmd":        cmd,
+		"User":       strconv.Itoa(sidecarProxyUID),
+		"Env":        req.env(),
+		"HostConfig": hostConfig,
+	}
+	return finalizeSidecarSpec(spec, req.Cfg.LabelPrefix)
+}
+
+// templateSidecarProvider builds the proxy container from an operator
+// supplied HCL template:
+//
+//	container {
+//	  image      = "example/proxy:1.0"        # defaults to SIDECAR_IMAGE
+//	  entrypoint = ["/usr/local/bin/proxy"]
+//	  cmd        = ["--service", service_id, "--consul", consul_http_addr]
+//	  user       = "1337"
+//	  env        = { PARENT = "${parent_id}" }
+//	  labels     = { team = "platform" }
+//	  ready_port = 8081                        # optional HTTP /ready endpoint
+//	}
+//
+// Available variables: service_id, service_name, proxy_id, parent_id,
+// consul_http_addr, consul_grpc_addr, image, namespace and partition.
+// NetworkMode, the restart policy and the hardening profile are always set by
+// the registrator. With transparent proxy, the container runs as the proxy
+// uid excluded from redirection; another user is rejected.
+type templateSidecarProvider struct {
+	body      *hclsyntax.Body
+	readyPort int
+}
+
+func loadTemplateSidecarProvider(path string) (*templateSidecarProvider, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := hclparse.NewParser()
+	f, diags := parser.ParseHCL(b, path)
+	if diags.HasErrors() {
+		return nil, errors.New(diags.Error())
+	}
+	body, ok := f.Body.(*hclsyntax.Body)
+	if !ok {
+		return nil, fmt.Errorf("invalid HCL body")
+	}
+
+	var container *hclsyntax.Block
+	for _, blk := range body.Blocks {
+		if blk.Type != "container" {
+			return nil, fmt.Errorf("unknown block %q", blk.Type)
+		}
+		if container != nil {
+			return nil, fmt.Errorf("multiple container blocks")
+		}
+		container = blk
+	}
+	if container == nil {
+		return nil, fmt.Errorf("missing container block")
+	}
+
+	t := &templateSidecarProvider{body: container.Body}
+
+	// Evaluate once with empty values to validate the template up front.
+	c, err := t.render(SidecarRequest{Cfg: &Config{}})
+	if err != nil {
+		return nil, err
+	}
+	t.readyPort = int(c.readyPort)
+	if t.readyPort != 0 && !isValidPort(t.readyPort) {
+		return nil, fmt.Errorf("container.ready_port: invalid port %d", t.readyPort)
+	}
+	return t, nil
+}
+
+func (*templateSidecarProvider) Kind() string { return sidecarProviderTemplate }
+
+func (t *templateSidecarProvider) ReadyPort(*SidecarOverrides) int { return t.readyPort }
+
+type renderedContainer struct {
+	image      string
+	entrypoint []string
+	cmd        []string
+	user       string
+	env        map[string]string
+	labels     map[string]string
+	readyPort  int64
+}
+
+func (t *templateSidecarProvider) render(req SidecarRequest) (*renderedContainer, error) {
+	evalCtx := &hcl.EvalContext{
+		Variables: map[string]cty.Value{
+			"service_id":       cty.StringVal(req.ServiceID),
+			"service_name":     cty.StringVal(req.Name),
+			"proxy_id":         cty.StringVal(req.ServiceID + "-sidecar-proxy"),
+			"parent_id":        cty.StringVal(req.ParentID),
+			"consul_http_addr": cty.StringVal(req.httpAddr()),
+			"consul_grpc_addr": cty.StringVal(req.grpcAddr()),
+			"image":            cty.StringVal(req.image()),
+			"namespace":        cty.StringVal(req.Scope.Namespace),
+			"partition":        cty.StringVal(req.Scope.Partition),
+		},
+	}
+
+	values, err := hclBodyToMapWithContext(t.body, evalCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &renderedContainer{}
+	s := &configSection{name: "container", values: values, used: map[string]bool{}}
+	s.str("image", &c.image)
+	s.list("entrypoint", &c.entrypoint)
+	s.list("cmd", &c.cmd)
+	s.str("user", &c.user)
+	s.stringMap("env", &c.env)
+	s.stringMap("labels", &c.labels)
+	s.integer("ready_port", &c.readyPort)
+	if err := errors.Join(s.finish()...); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (t *templateSidecarProvider) Build(req SidecarRequest) (*SidecarSpec, error) {
+	c, err := t.render(req)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := newSidecarSpec(req.ServiceID)
+	if req.NeedsNetAdmin {
+		// The redirect rules only let the proxy uid's own traffic through.
+		uid := strconv.Itoa(sidecarProxyUID)
+		if c.user != "" && strings.SplitN(c.user, ":", 2)[0] != uid {
+			return nil, fmt.Errorf("container.user %q: transparent proxy requires the proxy to run as uid %s", c.user, uid)
+		}
+		if c.user == "" {
+			c.user = uid
+		}
+		init, err := redirectInit(req, t.readyPort)
+		if err != nil {
+			return nil, err
+		}
+		spec.Init = init
+	}
+
+	hostConfig, err := sidecarHostConfig(req.ParentID, "unless-stopped", req.hardening(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	image := c.image
+	if image == "" {
+		image = req.image()
+	}
+	env := req.env()
+	for _, k := range sortedKeys(c.env) {
+		env = append(env, k+"="+c.env[k])
+	}
+	labels := map[string]string{}
+	for k, v := range c.labels {
+		labels[k] = v
+	}
+
+	config := map[string]interface{}{
+		"Image":      image,
+		"Env":        env,
+		"HostConfig": hostConfig,
+		"Labels":     labels,
+	}
+	if len(c.entrypoint) > 0 {
+		config["Entrypoint"] = c.entrypoint
+	}
+	if len(c.cmd) > 0 {
+		config["Cmd"] = c.cmd
+	}
+	if c.user != "" {
+		config["User"] = c.user
+	}
+	spec.Config = config
+	return finalizeSidecarSpec(spec, req.Cfg.LabelPrefix)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplateSidecarProviderUser(t *testing.T) {
+	tests := []struct {
+		name          string
+		user          string
+		needsNetAdmin bool
+		want          any
+		wantErr       string
+	}{
+		{name: "no user", want: nil},
+		{name: "template user", user: `user = "1000"`, want: "1000"},
+		{name: "transparent proxy default", needsNetAdmin: true, want: "1337"},
+		{name: "transparent proxy uid and gid", user: `user = "1337:1337"`, needsNetAdmin: true, want: "1337:1337"},
+		{name: "transparent proxy other uid", user: `user = "1000"`, needsNetAdmin: true, wantErr: "requires the proxy to run as uid 1337"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sidecar.hcl")
+			tmpl := "container {\n  image = \"example/proxy:1.0\"\n  " + tt.user + "\n}\n"
+			if err := os.WriteFile(path, []byte(tmpl), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			p, err := loadTemplateSidecarProvider(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			spec, err := p.Build(SidecarRequest{
+				ParentID:      "parent",
+				Name:          "web",
+				ServiceID:     "consul:parent:web",
+				Cfg:           defaultConfig(),
+				NeedsNetAdmin: tt.needsNetAdmin,
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := spec.Config["User"]; got != tt.want {
+				t.Errorf("User = %v, want %v", got, tt.want)
+			}
+			if tt.needsNetAdmin && spec.Init == nil {
+				t.Error("no redirect init container")
+			}
+		})
+	}
+}
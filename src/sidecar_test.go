@@ -0,0 +1,166 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSidecarOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		label   string
+		want    *SidecarOverrides
+		wantErr string
+	}{
+		{name: "empty", label: ""},
+		{name: "true", label: "true"},
+		{name: "false", label: "false"},
+		{name: "off", label: " Off "},
+		{
+			name: "overrides",
+			label: `sidecar {
+  provider   = "envoy"
+  admin_port = 19001
+  ready_port = 19101
+  env        = { FOO = "bar" }
+  exclude_inbound_ports = [9000]
+  resources { memory = "512m" }
+  bootstrap { envoy_stats_flush_interval = "10s" }
+}`,
+			want: &SidecarOverrides{
+				Provider:            "envoy",
+				AdminPort:           19001,
+				ReadyPort:           19101,
+				Env:                 map[string]string{"FOO": "bar"},
+				ExcludeInboundPorts: []int64{9000},
+				Memory:              "512m",
+				Bootstrap:           map[string]any{"envoy_stats_flush_interval": "10s"},
+			},
+		},
+		{name: "not hcl", label: "maybe", wantErr: "definition required"},
+		{name: "unknown attribute", label: `sidecar { admin = 1 }`, wantErr: "sidecar.admin: unknown attribute"},
+		{name: "unknown resource", label: "sidecar {\n  resources { disk = \"1g\" }\n}", wantErr: "sidecar.resources.disk: unknown attribute"},
+		{name: "wrong type", label: `sidecar { admin_port = "19001" }`, wantErr: "sidecar.admin_port: expected a number"},
+		{name: "invalid port", label: `sidecar { ready_port = 70000 }`, wantErr: "invalid port 70000"},
+		{name: "same ports", label: "sidecar {\n  admin_port = 19001\n  ready_port = 19001\n}", wantErr: "must differ"},
+		{name: "excluded port", label: `sidecar { exclude_outbound_ports = [0] }`, wantErr: "invalid excluded port 0"},
+		{name: "cidr", label: `sidecar { exclude_outbound_cidrs = ["10.0.0.0"] }`, wantErr: "exclude_outbound_cidrs"},
+		{name: "memory", label: "sidecar {\n  resources { memory = \"lots\" }\n}", wantErr: "sidecar.resources.memory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSidecarOverrides(tt.label)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSidecarOverrides() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSidecarDisabled(t *testing.T) {
+	for label, want := range map[string]bool{
+		"false": true, "0": true, "NO": true, "off": true,
+		"": false, "true": false, "sidecar {}": false,
+	} {
+		if got := sidecarDisabled(label); got != want {
+			t.Errorf("sidecarDisabled(%q) = %v, want %v", label, got, want)
+		}
+	}
+}
+
+func TestIsReservedSidecarPort(t *testing.T) {
+	ov := &SidecarOverrides{AdminPort: 19001, ReadyPort: 19101}
+	tests := []struct {
+		port int
+		ov   *SidecarOverrides
+		want bool
+	}{
+		{15001, nil, true},
+		{19000, nil, true},
+		{19100, nil, true},
+		{19101, nil, false},
+		{19000, ov, false},
+		{19001, ov, true},
+		{19101, ov, true},
+		{15090, ov, true},
+		{8080, ov, false},
+	}
+	for _, tt := range tests {
+		if got := isReservedSidecarPort(tt.port, tt.ov); got != tt.want {
+			t.Errorf("isReservedSidecarPort(%d, %+v) = %v, want %v", tt.port, tt.ov, got, tt.want)
+		}
+	}
+}
+
+func TestRedirectInitExcludedPorts(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SidecarPrometheusBindAddr = "0.0.0.0:9102"
+	req := SidecarRequest{
+		ServiceID: "consul:abc:web",
+		Cfg:       cfg,
+		Overrides: &SidecarOverrides{ExcludeInboundPorts: []int64{9000}},
+	}
+	init, err := redirectInit(req, 19101)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var excluded []string
+	cmd := init["Cmd"].([]string)
+	for i, arg := range cmd {
+		if arg == "-exclude-inbound-port" && i+1 < len(cmd) {
+			excluded = append(excluded, cmd[i+1])
+		}
+	}
+	if want := []string{"19101", "20200", "9102", "9000"}; !reflect.DeepEqual(excluded, want) {
+		t.Errorf("excluded inbound ports = %v, want %v", excluded, want)
+	}
+}
+
+func TestApplyEnvoyReadyGate(t *testing.T) {
+	tests := []struct {
+		name      string
+		svc       map[string]any
+		readyPort int
+		want      []any
+	}{
+		{
+			name:      "user check keeps its status",
+			svc:       map[string]any{"address": "10.0.0.2", "check": map[string]any{"http": "http://10.0.0.2/health", "status": "passing"}},
+			readyPort: 19100,
+			want: []any{
+				map[string]any{"HTTP": "http://10.0.0.2/health", "status": "passing"},
+				map[string]any{"Name": "Envoy Ready web", "HTTP": "http://10.0.0.2:19100/ready", "Interval": "10s", "Timeout": "2s", "Status": "critical"},
+			},
+		},
+		{
+			name:      "ready check already declared",
+			svc:       map[string]any{"address": "10.0.0.2", "checks": []any{map[string]any{"HTTP": "http://10.0.0.2:19101/ready"}}},
+			readyPort: 19101,
+			want:      []any{map[string]any{"HTTP": "http://10.0.0.2:19101/ready"}},
+		},
+		{
+			name: "no ready endpoint",
+			svc:  map[string]any{"checks": []any{map[string]any{"TCP": "web:80", "Status": "passing"}}},
+			want: []any{map[string]any{"TCP": "web:80", "Status": "passing"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			applyEnvoyReadyGate(tt.svc, "web", tt.readyPort)
+			if got := tt.svc["checks"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("checks = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,33 +1,84 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+// State is the reconciliation state of one Consul target. Each target has
+// its own, saved in its own store, so a failure or a configuration change on
+// one target does not affect the services of the others.
 type State struct {
-	Services      map[string]bool   `json:"services"`
-	ServiceHashes map[string]string `json:"service_hashes"`
+	Services      map[string]bool      `json:"services"`
+	ServiceHashes map[string]string    `json:"service_hashes"`
+	RegisteredAt  map[string]time.Time `json:"registered_at"`
+	VerifiedAt    map[string]time.Time `json:"verified_at"`
+	// SidecarChecks holds the services whose sidecar failure check is
+	// currently registered in Consul.
+	SidecarChecks map[string]bool `json:"sidecar_checks,omitempty"`
+	// Scopes holds the target, namespace and partition of services
+	// registered outside the default scope, so they are deregistered there.
+	Scopes map[string]ConsulScope `json:"scopes,omitempty"`
+	// ConfigEntries holds the config entries written from service labels,
+	// by configEntryKey, so they are removed with the last container of
+	// their service.
+	ConfigEntries map[string]ConfigEntryState `json:"config_entries,omitempty"`
 }
 
-func LoadState(path string) (*State, error) {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return &State{
-			Services:      map[string]bool{},
-			ServiceHashes: map[string]string{},
-		}, nil
+func newState() *State {
+	return &State{
+		Services:      map[string]bool{},
+		ServiceHashes: map[string]string{},
+		RegisteredAt:  map[string]time.Time{},
+		VerifiedAt:    map[string]time.Time{},
+		SidecarChecks: map[string]bool{},
+		Scopes:        map[string]ConsulScope{},
+		ConfigEntries: map[string]ConfigEntryState{},
 	}
+}
 
-	var s State
-	err = json.Unmarshal(b, &s)
-
+func (s *State) init() {
 	if s.Services == nil {
 		s.Services = map[string]bool{}
 	}
 	if s.ServiceHashes == nil {
 		s.ServiceHashes = map[string]string{}
 	}
+	if s.RegisteredAt == nil {
+		s.RegisteredAt = map[string]time.Time{}
+	}
+	if s.VerifiedAt == nil {
+		s.VerifiedAt = map[string]time.Time{}
+	}
+	if s.SidecarChecks == nil {
+		s.SidecarChecks = map[string]bool{}
+	}
+	if s.Scopes == nil {
+		s.Scopes = map[string]ConsulScope{}
+	}
+	if s.ConfigEntries == nil {
+		s.ConfigEntries = map[string]ConfigEntryState{}
+	}
+}
+
+func LoadState(path string) (*State, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return newState(), nil
+	}
+
+	var s State
+	err = json.Unmarshal(b, &s)
+	s.init()
 
 	return &s, err
 }
@@ -39,3 +90,214 @@ func SaveState(path string, s *State) error {
 	}
 	return os.WriteFile(path, b, 0644)
 }
+
+func (s *State) Forget(serviceID string) {
+	delete(s.Services, serviceID)
+	delete(s.ServiceHashes, serviceID)
+	delete(s.RegisteredAt, serviceID)
+	delete(s.VerifiedAt, serviceID)
+	delete(s.SidecarChecks, serviceID)
+	delete(s.Scopes, serviceID)
+}
+
+// move transfers the entries of serviceID from s to o.
+func (s *State) move(serviceID string, o *State) {
+	moveEntry(s.Services, o.Services, serviceID)
+	moveEntry(s.ServiceHashes, o.ServiceHashes, serviceID)
+	moveEntry(s.RegisteredAt, o.RegisteredAt, serviceID)
+	moveEntry(s.VerifiedAt, o.VerifiedAt, serviceID)
+	moveEntry(s.SidecarChecks, o.SidecarChecks, serviceID)
+	moveEntry(s.Scopes, o.Scopes, serviceID)
+}
+
+func moveEntry[V any](src, dst map[string]V, key string) {
+	if v, ok := src[key]; ok {
+		dst[key] = v
+		delete(src, key)
+	}
+}
+
+// splitByTarget moves the services and config entries of other targets out
+// of the default target's state into theirs, for states saved when all the
+// targets shared one. Entries of targets without a state stay in place.
+func splitByTarget(states map[string]*State) {
+	def := states[defaultTarget]
+	if def == nil {
+		return
+	}
+	for id, scope := range def.Scopes {
+		if st := states[scope.targetName()]; st != nil && st != def {
+			def.move(id, st)
+		}
+	}
+	for key, e := range def.ConfigEntries {
+		if st := states[e.Scope.targetName()]; st != nil && st != def {
+			moveEntry(def.ConfigEntries, st.ConfigEntries, key)
+		}
+	}
+}
+
+// merge adds the entries of o that s does not know, e.g. services
+// registered by a run whose state write raced with this one. They are then
+// reconciled like any other: deregistered if no container declares them.
+func (s *State) merge(o *State) {
+	mergeMissing(s.Services, o.Services)
+	mergeMissing(s.ServiceHashes, o.ServiceHashes)
+	mergeMissing(s.RegisteredAt, o.RegisteredAt)
+	mergeMissing(s.VerifiedAt, o.VerifiedAt)
+	mergeMissing(s.SidecarChecks, o.SidecarChecks)
+	mergeMissing(s.Scopes, o.Scopes)
+	mergeMissing(s.ConfigEntries, o.ConfigEntries)
+}
+
+func mergeMissing[V any](dst, src map[string]V) {
+	for k, v := range src {
+		if _, ok := dst[k]; !ok {
+			dst[k] = v
+		}
+	}
+}
+
+// setScope records the scope a service is registered in.
+func (s *State) setScope(serviceID string, scope ConsulScope) {
+	if scope == (ConsulScope{}) {
+		delete(s.Scopes, serviceID)
+		return
+	}
+	s.Scopes[serviceID] = scope
+}
+
+// StateStore persists the agent State between cycles and restarts.
+type StateStore interface {
+	Load(ctx context.Context) (*State, error)
+	Save(ctx context.Context, s *State) error
+}
+
+// FileStateStore keeps the state in a local JSON file. A file that cannot
+// be parsed is renamed to <path>.corrupt before the first write, instead of
+// being overwritten.
+type FileStateStore struct {
+	path    string
+	corrupt bool
+}
+
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{path: path}
+}
+
+func (f *FileStateStore) Load(_ context.Context) (*State, error) {
+	s, err := LoadState(f.path)
+	f.corrupt = err != nil
+	return s, err
+}
+
+func (f *FileStateStore) Save(_ context.Context, s *State) error {
+	if f.corrupt {
+		if err := os.Rename(f.path, f.path+".corrupt"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("move unreadable state file aside: %w", err)
+		}
+		slog.Warn("moved unreadable state file aside", "path", f.path+".corrupt")
+		f.corrupt = false
+	}
+	return SaveState(f.path, s)
+}
+
+// ConsulKVStateStore keeps the state in the Consul KV store, so the
+// registrator does not need any writable volume. Writes use check-and-set on
+// the last seen ModifyIndex. Nothing is written before the stored state was
+// read: if the initial Load failed, or a concurrent writer changed the key,
+// Save first reads it back and merges it into the state being saved.
+type ConsulKVStateStore struct {
+	consul *ConsulClient
+	key    string
+	index  uint64
+	// loaded is set once the stored state and its index are known.
+	loaded bool
+}
+
+func NewConsulKVStateStore(consul *ConsulClient, key string) *ConsulKVStateStore {
+	return &ConsulKVStateStore{consul: consul, key: strings.Trim(key, "/")}
+}
+
+// targetStatePath returns the state file of a target: path for the default
+// target, <path without extension>.<target><extension> for the others.
+func targetStatePath(path, target string) string {
+	if target == defaultTarget {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + fileSafe(target) + ext
+}
+
+// consulStateKey builds the KV key for a node: <prefix>/<node>.
+func consulStateKey(prefix, node string) string {
+	return strings.Trim(prefix, "/") + "/" + node
+}
+
+func (c *ConsulKVStateStore) Load(ctx context.Context) (*State, error) {
+	b, index, found, err := c.consul.KVGet(ctx, c.key)
+	if err != nil {
+		return newState(), err
+	}
+	// An unreadable value cannot be merged: it is overwritten on Save.
+	c.index = index
+	c.loaded = true
+	if !found {
+		return newState(), nil
+	}
+
+	var s State
+	err = json.Unmarshal(b, &s)
+	s.init()
+
+	return &s, err
+}
+
+// Save writes s. The stored state is merged into s first when it was not
+// read yet, and again after a check-and-set conflict, before one retry.
+func (c *ConsulKVStateStore) Save(ctx context.Context, s *State) error {
+	for attempt := 0; ; attempt++ {
+		if !c.loaded {
+			stored, err := c.Load(ctx)
+			if err != nil && !c.loaded {
+				return fmt.Errorf("read state before writing: %w", err)
+			}
+			s.merge(stored)
+		}
+
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+
+		cas := c.index
+		ok, err := c.consul.KVPut(ctx, c.key, b, cas)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return c.readIndex(ctx, b)
+		}
+		c.loaded = false
+		if attempt > 0 {
+			return fmt.Errorf("state key %q was modified concurrently (cas=%d)", c.key, cas)
+		}
+	}
+}
+
+// readIndex records the ModifyIndex of the value just written, b. If
+// another writer already replaced it, or it cannot be read, the next Save
+// reads and merges the stored state first.
+func (c *ConsulKVStateStore) readIndex(ctx context.Context, b []byte) error {
+	value, index, found, err := c.consul.KVGet(ctx, c.key)
+	if err != nil {
+		c.loaded = false
+		return err
+	}
+	if !found || !bytes.Equal(value, b) {
+		c.loaded = false
+		return nil
+	}
+	c.index = index
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKV is a single-key Consul KV endpoint with check-and-set.
+type fakeKV struct {
+	mu    sync.Mutex
+	value []byte
+	index uint64
+	// failGets makes the next GETs fail with 500.
+	failGets int
+	// racer, if set, is written right after the next successful PUT, as by
+	// a writer that saves before the index is read back.
+	racer []byte
+}
+
+func (f *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		if f.failGets > 0 {
+			f.failGets--
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		if f.index == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]map[string]any{{"ModifyIndex": f.index, "Value": f.value}})
+	case http.MethodPut:
+		cas, _ := strconv.ParseUint(r.URL.Query().Get("cas"), 10, 64)
+		if cas != f.index {
+			_, _ = io.WriteString(w, "false")
+			return
+		}
+		f.value, _ = io.ReadAll(r.Body)
+		f.index++
+		if f.racer != nil {
+			f.value, f.racer = f.racer, nil
+			f.index++
+		}
+		_, _ = io.WriteString(w, "true")
+	}
+}
+
+// write stores s as a concurrent writer would.
+func (f *fakeKV) write(t *testing.T, s *State) {
+	t.Helper()
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	f.value = b
+	f.index++
+	f.mu.Unlock()
+}
+
+func (f *fakeKV) stored(t *testing.T) *State {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var s State
+	if err := json.Unmarshal(f.value, &s); err != nil {
+		t.Fatal(err)
+	}
+	return &s
+}
+
+func newKVStore(t *testing.T, kv *fakeKV) *ConsulKVStateStore {
+	t.Helper()
+	srv := httptest.NewServer(kv)
+	t.Cleanup(srv.Close)
+	return NewConsulKVStateStore(NewConsulClient(srv.URL, "", time.Second, false), "state/node")
+}
+
+func stateWith(ids ...string) *State {
+	s := newState()
+	for _, id := range ids {
+		s.Services[id] = true
+	}
+	return s
+}
+
+func TestConsulKVStateStoreMergesOnConflict(t *testing.T) {
+	ctx := context.Background()
+	kv := &fakeKV{}
+	store := newKVStore(t, kv)
+
+	s, err := store.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Services["a:1"] = true
+	if err := store.Save(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+
+	kv.write(t, stateWith("a:1", "b:2"))
+	s.Services["c:3"] = true
+	if err := store.Save(ctx, s); err != nil {
+		t.Fatalf("save after concurrent write: %v", err)
+	}
+
+	got := kv.stored(t)
+	for _, id := range []string{"a:1", "b:2", "c:3"} {
+		if !got.Services[id] {
+			t.Errorf("stored state lost %s: %v", id, got.Services)
+		}
+	}
+}
+
+func TestConsulKVStateStoreReadsBeforeFirstWrite(t *testing.T) {
+	ctx := context.Background()
+	kv := &fakeKV{failGets: 1}
+	kv.write(t, stateWith("old:1"))
+	store := newKVStore(t, kv)
+
+	if _, err := store.Load(ctx); err == nil {
+		t.Fatal("Load succeeded, want the injected error")
+	}
+	s := stateWith("new:1")
+	if err := store.Save(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.Services["old:1"] {
+		t.Errorf("services of the previous run were not merged: %v", s.Services)
+	}
+	if got := kv.stored(t); !got.Services["old:1"] || !got.Services["new:1"] {
+		t.Errorf("stored services = %v, want old:1 and new:1", got.Services)
+	}
+}
+
+func TestConsulKVStateStoreDoesNotWriteUnread(t *testing.T) {
+	ctx := context.Background()
+	kv := &fakeKV{failGets: 2}
+	kv.write(t, stateWith("old:1"))
+	store := newKVStore(t, kv)
+
+	_, _ = store.Load(ctx)
+	if err := store.Save(ctx, stateWith("new:1")); err == nil {
+		t.Fatal("Save succeeded while the stored state could not be read")
+	}
+	if got := kv.stored(t); !got.Services["old:1"] || got.Services["new:1"] {
+		t.Errorf("stored services = %v, want them untouched", got.Services)
+	}
+}
+
+func TestConsulKVStateStoreWriteAfterPut(t *testing.T) {
+	ctx := context.Background()
+	kv := &fakeKV{}
+	store := newKVStore(t, kv)
+
+	s, err := store.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Services["a:1"] = true
+	racer, _ := json.Marshal(stateWith("b:2"))
+	kv.racer = racer
+	if err := store.Save(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Services["c:3"] = true
+	if err := store.Save(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	got := kv.stored(t)
+	for _, id := range []string{"a:1", "b:2", "c:3"} {
+		if !got.Services[id] {
+			t.Errorf("stored state lost %s: %v", id, got.Services)
+		}
+	}
+}
+
+func TestFileStateStoreMovesUnreadableFileAside(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store := NewFileStateStore(path)
+
+	if _, err := store.Load(ctx); err == nil {
+		t.Fatal("Load succeeded, want a parse error")
+	}
+	if err := store.Save(ctx, stateWith("new:1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := os.ReadFile(path + ".corrupt"); err != nil || string(b) != "{not json" {
+		t.Errorf("unreadable file = %q, %v, want it moved aside", b, err)
+	}
+	if s, err := LoadState(path); err != nil || !s.Services["new:1"] {
+		t.Errorf("saved state = %v, %v", s.Services, err)
+	}
+}
+
+func TestSplitByTarget(t *testing.T) {
+	def := stateWith("web:1", "api:1", "db:1")
+	def.Scopes["api:1"] = ConsulScope{Target: "dc2"}
+	def.ServiceHashes["api:1"] = "h"
+	def.Scopes["db:1"] = ConsulScope{Target: "gone"}
+	def.ConfigEntries["dc2///service-defaults/api"] = ConfigEntryState{Kind: "service-defaults", Name: "api", Scope: ConsulScope{Target: "dc2"}}
+	dc2 := newState()
+
+	splitByTarget(map[string]*State{defaultTarget: def, "dc2": dc2})
+
+	if !def.Services["web:1"] || def.Services["api:1"] || !def.Services["db:1"] {
+		t.Errorf("default services = %v, want web:1 and db:1 (no state for its target)", def.Services)
+	}
+	if !dc2.Services["api:1"] || dc2.ServiceHashes["api:1"] != "h" || dc2.Scopes["api:1"].Target != "dc2" {
+		t.Errorf("dc2 state = %+v, want api:1 moved", dc2)
+	}
+	if len(def.ConfigEntries) != 0 || len(dc2.ConfigEntries) != 1 {
+		t.Errorf("config entries default=%v dc2=%v, want the dc2 entry moved", def.ConfigEntries, dc2.ConfigEntries)
+	}
+}
+
+func TestTargetStatePath(t *testing.T) {
+	tests := []struct{ path, target, want string }{
+		{"/tmp/registrator-state.json", defaultTarget, "/tmp/registrator-state.json"},
+		{"/tmp/registrator-state.json", "dc2", "/tmp/registrator-state.dc2.json"},
+		{"/data/state", "eu/west", "/data/state.eu_west"},
+	}
+	for _, tt := range tests {
+		if got := targetStatePath(tt.path, tt.target); got != tt.want {
+			t.Errorf("targetStatePath(%q, %q) = %q, want %q", tt.path, tt.target, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// defaultTarget names the Consul agent set by CONSUL_HTTP_ADDR and the
+// consul block. Services without a <prefix>.target.<name> label use it.
+const defaultTarget = "default"
+
+// ConsulTarget is a Consul agent services can be registered with, e.g. one
+// per datacenter or cluster.
+type ConsulTarget struct {
+	Name    string
+	Address string
+	Token   string
+	// Default namespace and partition of the target's services.
+	Namespace string
+	Partition string
+	TLS       ConsulTLS
+
+	// Agent addresses as seen from sidecars; the global sidecar settings
+	// when empty.
+	SidecarHttpAddr string
+	SidecarGrpcAddr string
+}
+
+// ConsulTLS configures HTTPS to a Consul agent.
+type ConsulTLS struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	SkipVerify bool
+}
+
+// scope is the default scope of the target's services.
+func (t ConsulTarget) scope() ConsulScope {
+	s := ConsulScope{Namespace: t.Namespace, Partition: t.Partition}
+	if t.Name != defaultTarget {
+		s.Target = t.Name
+	}
+	return s
+}
+
+// config returns the client TLS settings, or nil when nothing is set.
+func (t ConsulTLS) config() (*tls.Config, error) {
+	if t == (ConsulTLS{}) {
+		return nil, nil
+	}
+	c := &tls.Config{ServerName: t.ServerName, InsecureSkipVerify: t.SkipVerify}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", t.CAFile)
+		}
+		c.RootCAs = pool
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// target returns the named target; "" is the default one.
+func (cfg *Config) target(name string) (ConsulTarget, bool) {
+	if name == "" || name == defaultTarget {
+		return ConsulTarget{
+			Name:      defaultTarget,
+			Address:   cfg.ConsulAddr,
+			Token:     cfg.ConsulToken,
+			Namespace: cfg.ConsulNamespace,
+			Partition: cfg.ConsulPartition,
+			TLS:       cfg.ConsulTLS,
+		}, true
+	}
+	t, ok := cfg.Targets[name]
+	return t, ok
+}
+
+// targetNames returns the default target followed by the others, sorted.
+func (cfg *Config) targetNames() []string {
+	return append([]string{defaultTarget}, sortedKeys(cfg.Targets)...)
+}
+
+func (cfg *Config) validateTargets() []error {
+	var errs []error
+	for _, name := range cfg.targetNames() {
+		t, _ := cfg.target(name)
+		if name != defaultTarget {
+			if strings.TrimSpace(t.Address) == "" {
+				errs = append(errs, fmt.Errorf("target %q: address must be set", name))
+			}
+			if strings.ContainsAny(name, " \t,=") {
+				errs = append(errs, fmt.Errorf("invalid target name %q", name))
+			}
+		}
+		if _, err := t.TLS.config(); err != nil {
+			errs = append(errs, fmt.Errorf("target %q: tls: %w", name, err))
+		}
+	}
+	return errs
+}
+
+// NewConsulTargets returns a client per target, by name, with its latency
+// recorded in m under the target's name.
+func NewConsulTargets(cfg *Config, m *Metrics) (map[string]*ConsulClient, error) {
+	clients := map[string]*ConsulClient{}
+	var errs []error
+	for _, name := range cfg.targetNames() {
+		t, _ := cfg.target(name)
+		c := NewConsulClient(t.Address, t.Token, 5*time.Second, false)
+		tlsCfg, err := t.TLS.config()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("target %q: tls: %w", name, err))
+			continue
+		}
+		if tlsCfg != nil {
+			c.client.Transport = &http.Transport{TLSClientConfig: tlsCfg}
+		}
+		c.Instrument(m, name)
+		clients[name] = c
+	}
+	return clients, errors.Join(errs...)
+}
+
+// sameTargets reports whether a and b configure the same Consul targets.
+func sameTargets(a, b *Config) bool {
+	if !reflect.DeepEqual(a.targetNames(), b.targetNames()) {
+		return false
+	}
+	for _, name := range a.targetNames() {
+		ta, _ := a.target(name)
+		tb, _ := b.target(name)
+		if ta != tb {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "consul-registrator"
+
+// tracer creates the spans of the agent. It is a no-op until setupTracing
+// installs a provider.
+var tracer = otel.Tracer(tracerName)
+
+// setupTracing installs a tracer provider exporting spans over OTLP/HTTP when
+// tracing is enabled. The returned function flushes and stops the exporter.
+// An empty endpoint leaves the exporter to the standard
+// OTEL_EXPORTER_OTLP_* environment variables.
+func setupTracing(ctx context.Context, cfg *Config) (func(context.Context) error, error) {
+	if !cfg.TracingEnabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var opts []otlptracehttp.Option
+	if cfg.TracingEndpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(cfg.TracingEndpoint))
+	}
+	if cfg.TracingInsecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exp, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := newTracerProvider(exp)
+	otel.SetTracerProvider(tp)
+	slog.Info("tracing enabled", "endpoint", cfg.TracingEndpoint)
+	return tp.Shutdown, nil
+}
+
+// newTracerProvider returns a provider batching spans to exp, e.g. an OTLP
+// exporter or an in-memory one.
+func newTracerProvider(exp sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	res := resource.NewSchemaless(attribute.String("service.name", tracerName))
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceHandler adds the trace and span IDs of the record's context to log
+// records, so logs can be joined with traces.
+type traceHandler struct {
+	slog.Handler
+}
+
+func (h traceHandler) Handle(ctx context.Context, r slog.Record) error {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+// parseUpstreamsLabel parses the value of a consul.upstreams.<name> label:
+// comma-separated "<service>:<local bind port>" pairs, e.g.
+// "db:5432,cache:6379".
+func parseUpstreamsLabel(value string) ([]map[string]any, error) {
+	var out []map[string]any
+	for _, it := range strings.Split(value, ",") {
+		it = strings.TrimSpace(it)
+		if it == "" {
+			continue
+		}
+		name, port, ok := strings.Cut(it, ":")
+		name = strings.TrimSpace(name)
+		p, err := strconv.Atoi(strings.TrimSpace(port))
+		if !ok || name == "" || err != nil {
+			return nil, fmt.Errorf("invalid upstream %q, want <service>:<port>", it)
+		}
+		out = append(out, map[string]any{
+			"destination_name": name,
+			"local_bind_port":  int64(p),
+		})
+	}
+	return out, nil
+}
+
+// parseUpstreamBlocks decodes the `upstream "<service>" { ... }` blocks of a
+// service label. The label sets destination_name.
+func parseUpstreamBlocks(blocks []*hclsyntax.Block) ([]map[string]any, error) {
+	var out []map[string]any
+	for _, b := range blocks {
+		if len(b.Labels) > 1 {
+			return nil, fmt.Errorf(`upstream blocks take one label: upstream "<service>" { ... }`)
+		}
+		up, err := hclBodyToMap(b.Body)
+		if err != nil {
+			return nil, fmt.Errorf("upstream: %w", err)
+		}
+		if len(b.Labels) == 1 {
+			if name := upstreamString(up, "destination_name", "DestinationName"); name != "" && name != b.Labels[0] {
+				return nil, fmt.Errorf("upstream %q: destination_name %q does not match the block label", b.Labels[0], name)
+			}
+			up["destination_name"] = b.Labels[0]
+		}
+		if upstreamString(up, "destination_name", "DestinationName") == "" {
+			return nil, fmt.Errorf("upstream: destination_name must be set")
+		}
+		out = append(out, up)
+	}
+	return out, nil
+}
+
+// addUpstreams adds upstreams to the sidecar proxy of svc, creating its
+// connect.sidecar_service.proxy as needed; keys already written in the
+// Consul API casing (Connect, SidecarService...) are reused. Upstreams need
+// a sidecar: one requested for the service, or a sidecar_service block in
+// its label. Every local bind port, including those of the upstreams
+// already in the proxy, must be set and distinct, differ from the service
+// port and not be one the sidecar listens on.
+func addUpstreams(svc map[string]any, upstreams []map[string]any, sidecarRequested bool, ov *SidecarOverrides) error {
+	if len(upstreams) == 0 {
+		return nil
+	}
+	if !sidecarRequested && findMap(findMap(svc, "connect", "Connect"), "sidecar_service", "SidecarService") == nil {
+		return errors.New("upstreams need a sidecar: request one or declare connect.sidecar_service")
+	}
+
+	connect := childMap(svc, "connect", "Connect")
+	sidecar := childMap(connect, "sidecar_service", "SidecarService")
+	proxy := childMap(sidecar, "proxy", "Proxy")
+
+	key := "upstreams"
+	if _, ok := proxy["Upstreams"]; ok {
+		key = "Upstreams"
+	}
+	var all []any
+	switch x := proxy[key].(type) {
+	case []any:
+		all = append(all, x...)
+	case map[string]any:
+		all = append(all, x)
+	}
+	for _, up := range upstreams {
+		all = append(all, up)
+	}
+
+	svcPort := intFromAny(svc["port"])
+	if svcPort == 0 {
+		svcPort = intFromAny(svc["Port"])
+	}
+	ports := map[int]string{}
+	names := map[string]bool{}
+	for _, it := range all {
+		up, ok := it.(map[string]any)
+		if !ok {
+			return fmt.Errorf("invalid upstream %v", it)
+		}
+		name := upstreamString(up, "destination_name", "DestinationName")
+		dest := name + "@" + upstreamString(up, "datacenter", "Datacenter")
+		if names[dest] {
+			return fmt.Errorf("upstream %q declared twice", name)
+		}
+		names[dest] = true
+
+		port := intFromAny(up["local_bind_port"])
+		if port == 0 {
+			port = intFromAny(up["LocalBindPort"])
+		}
+		switch {
+		case port < 1 || port > 65535:
+			return fmt.Errorf("upstream %q: invalid local_bind_port %d", name, port)
+		case isReservedSidecarPort(port, ov):
+			return fmt.Errorf("upstream %q: local_bind_port %d is used by the sidecar", name, port)
+		case port == svcPort:
+			return fmt.Errorf("upstream %q: local_bind_port %d is the service port", name, port)
+		case ports[port] != "":
+			return fmt.Errorf("upstreams %q and %q both bind port %d", ports[port], name, port)
+		}
+		ports[port] = name
+	}
+
+	proxy[key] = all
+	return nil
+}
+
+// childMap returns the map at the first of keys set in m, creating it at
+// keys[0] if none is.
+func childMap(m map[string]any, keys ...string) map[string]any {
+	if c := findMap(m, keys...); c != nil {
+		return c
+	}
+	c := map[string]any{}
+	m[keys[0]] = c
+	return c
+}
+
+// findMap returns the first of the keys of m holding a map, or nil.
+func findMap(m map[string]any, keys ...string) map[string]any {
+	for _, k := range keys {
+		if c, ok := m[k].(map[string]any); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+func upstreamString(up map[string]any, keys ...string) string {
+	for _, k := range keys {
+		if v, ok := up[k].(string); ok && v != "" {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseUpstreamsLabel(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []map[string]any
+		wantErr bool
+	}{
+		{name: "empty", value: ""},
+		{
+			name:  "pairs",
+			value: " db:5432, cache:6379,",
+			want: []map[string]any{
+				{"destination_name": "db", "local_bind_port": int64(5432)},
+				{"destination_name": "cache", "local_bind_port": int64(6379)},
+			},
+		},
+		{name: "no port", value: "db", wantErr: true},
+		{name: "no name", value: ":5432", wantErr: true},
+		{name: "bad port", value: "db:pg", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseUpstreamsLabel(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseUpstreamsLabel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseUpstreamBlocks(t *testing.T) {
+	tests := []struct {
+		name      string
+		label     string
+		wantNames []string
+		wantErr   string
+	}{
+		{
+			name:      "labeled",
+			label:     "service {\n  upstream \"db\" {\n    local_bind_port = 5432\n  }\n  upstream \"cache\" {\n    local_bind_port = 6379\n  }\n}",
+			wantNames: []string{"db", "cache"},
+		},
+		{
+			name:      "unlabeled",
+			label:     "service {\n  upstream {\n    destination_name = \"db\"\n    local_bind_port  = 5432\n  }\n}",
+			wantNames: []string{"db"},
+		},
+		{
+			name:    "mismatched name",
+			label:   "service {\n  upstream \"db\" {\n    destination_name = \"pg\"\n  }\n}",
+			wantErr: "does not match the block label",
+		},
+		{
+			name:    "no name",
+			label:   "service {\n  upstream {\n    local_bind_port = 5432\n  }\n}",
+			wantErr: "destination_name must be set",
+		},
+		{
+			name:    "two labels",
+			label:   "service {\n  upstream \"db\" \"pg\" {}\n}",
+			wantErr: "upstream blocks take one label",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := ParseServiceHCL(tt.label)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, up := range parsed.Upstreams {
+				names = append(names, upstreamString(up, "destination_name"))
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("upstreams = %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestAddUpstreams(t *testing.T) {
+	up := func(name string, port int64) map[string]any {
+		return map[string]any{"destination_name": name, "local_bind_port": port}
+	}
+	tests := []struct {
+		name string
+		svc  map[string]any
+		ups  []map[string]any
+		ov   *SidecarOverrides
+		// no sidecar requested for the service
+		noSidecar bool
+		wantErr   string
+		// path to the upstreams of the result, and their count
+		path []string
+		want int
+	}{
+		{
+			name: "new proxy",
+			svc:  map[string]any{"port": 8080},
+			ups:  []map[string]any{up("db", 5432), up("cache", 6379)},
+			path: []string{"connect", "sidecar_service", "proxy", "upstreams"},
+			want: 2,
+		},
+		{
+			name: "existing lower-case proxy",
+			svc: map[string]any{"connect": map[string]any{"sidecar_service": map[string]any{"proxy": map[string]any{
+				"upstreams": map[string]any{"destination_name": "api", "local_bind_port": 9000},
+			}}}},
+			ups:  []map[string]any{up("db", 5432)},
+			path: []string{"connect", "sidecar_service", "proxy", "upstreams"},
+			want: 2,
+		},
+		{
+			name: "existing API-cased proxy",
+			svc: map[string]any{"Connect": map[string]any{"SidecarService": map[string]any{"Proxy": map[string]any{
+				"Upstreams": []any{map[string]any{"DestinationName": "api", "LocalBindPort": 9000}},
+			}}}},
+			ups:  []map[string]any{up("db", 5432)},
+			path: []string{"Connect", "SidecarService", "Proxy", "Upstreams"},
+			want: 2,
+		},
+		{
+			name: "API-cased port collision",
+			svc: map[string]any{"Connect": map[string]any{"SidecarService": map[string]any{"Proxy": map[string]any{
+				"Upstreams": []any{map[string]any{"DestinationName": "api", "LocalBindPort": 5432}},
+			}}}},
+			ups:     []map[string]any{up("db", 5432)},
+			wantErr: `upstreams "api" and "db" both bind port 5432`,
+		},
+		{
+			name:    "duplicate port",
+			ups:     []map[string]any{up("db", 5432), up("pg", 5432)},
+			wantErr: `upstreams "db" and "pg" both bind port 5432`,
+		},
+		{
+			name:    "duplicate destination",
+			ups:     []map[string]any{up("db", 5432), up("db", 5433)},
+			wantErr: `upstream "db" declared twice`,
+		},
+		{
+			name: "same destination in another datacenter",
+			ups:  []map[string]any{up("db", 5432), {"destination_name": "db", "datacenter": "dc2", "local_bind_port": int64(5433)}},
+			path: []string{"connect", "sidecar_service", "proxy", "upstreams"},
+			want: 2,
+		},
+		{
+			name:    "service port",
+			svc:     map[string]any{"Port": 8080},
+			ups:     []map[string]any{up("db", 8080)},
+			wantErr: "is the service port",
+		},
+		{
+			name:    "transparent proxy port",
+			ups:     []map[string]any{up("db", 15001)},
+			wantErr: "is used by the sidecar",
+		},
+		{
+			name:    "overridden admin port",
+			ups:     []map[string]any{up("db", 19100)},
+			ov:      &SidecarOverrides{AdminPort: 19100},
+			wantErr: "is used by the sidecar",
+		},
+		{
+			name:    "overridden ready port",
+			ups:     []map[string]any{up("db", 21001)},
+			ov:      &SidecarOverrides{ReadyPort: 21001},
+			wantErr: "is used by the sidecar",
+		},
+		{
+			name:      "no sidecar",
+			svc:       map[string]any{"port": 8080},
+			ups:       []map[string]any{up("db", 5432)},
+			noSidecar: true,
+			wantErr:   "upstreams need a sidecar",
+		},
+		{
+			name:      "no sidecar, sidecar_service in the label",
+			svc:       map[string]any{"connect": map[string]any{"sidecar_service": map[string]any{}}},
+			ups:       []map[string]any{up("db", 5432)},
+			noSidecar: true,
+			path:      []string{"connect", "sidecar_service", "proxy", "upstreams"},
+			want:      1,
+		},
+		{
+			name:    "invalid port",
+			ups:     []map[string]any{up("db", 0)},
+			wantErr: "invalid local_bind_port 0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := tt.svc
+			if svc == nil {
+				svc = map[string]any{}
+			}
+			err := addUpstreams(svc, tt.ups, !tt.noSidecar, tt.ov)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				if _, ok := svc["connect"]; ok && tt.noSidecar {
+					t.Errorf("connect added without a sidecar: %v", svc)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var node any = svc
+			for _, k := range tt.path {
+				m, ok := node.(map[string]any)
+				if !ok {
+					t.Fatalf("no %s in %v", strings.Join(tt.path, "."), svc)
+				}
+				node = m[k]
+			}
+			if got, _ := node.([]any); len(got) != tt.want {
+				t.Errorf("%s = %v, want %d upstreams", strings.Join(tt.path, "."), node, tt.want)
+			}
+			if _, ok := svc["connect"]; ok && tt.path[0] == "Connect" {
+				t.Errorf("connect added next to Connect: %v", svc)
+			}
+		})
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"log"
 	"os"
 )
 
@@ -15,7 +14,7 @@ func envOr(key, def string) string {
 func requireEnv(key string) string {
 	v := os.Getenv(key)
 	if v == "" {
-		log.Fatalf("missing mandatory environment variable: %s", key)
+		fatal("missing mandatory environment variable", "key", key)
 	}
 	return v
 }